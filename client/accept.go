@@ -0,0 +1,204 @@
+package client
+
+import (
+	"Draylix2/dlog"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const maxAcceptDelay = time.Second
+
+// connTracker 记录正在处理的本地连接，限制总数和每个来源 IP 的连接数
+type connTracker struct {
+	mutex    sync.Mutex
+	wg       sync.WaitGroup
+	closed   bool
+	done     chan struct{}
+	slots    chan struct{}
+	perIP    map[string]int
+	maxPerIP int
+	conns    map[net.Conn]string
+	// waiting 是还在握手或等待下一个 HTTP 请求的连接，关闭时直接断开
+	waiting map[net.Conn]bool
+}
+
+func (t *connTracker) init(maxConns, maxPerIP int) {
+	t.done = make(chan struct{})
+	if maxConns > 0 {
+		t.slots = make(chan struct{}, maxConns)
+	}
+	t.maxPerIP = maxPerIP
+	t.perIP = make(map[string]int)
+	t.conns = make(map[net.Conn]string)
+	t.waiting = make(map[net.Conn]bool)
+}
+
+// acquire 等待一个空闲的连接名额，关闭后返回 false
+func (t *connTracker) acquire() bool {
+	if t.slots == nil {
+		return true
+	}
+	select {
+	case t.slots <- struct{}{}:
+		return true
+	case <-t.done:
+		return false
+	}
+}
+
+func (t *connTracker) release() {
+	if t.slots != nil {
+		<-t.slots
+	}
+}
+
+// add 登记一个连接，已关闭或来源 IP 超出限制时返回错误
+func (t *connTracker) add(conn net.Conn) error {
+	ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		ip = conn.RemoteAddr().String()
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.closed {
+		return net.ErrClosed
+	}
+	if t.maxPerIP > 0 && t.perIP[ip] >= t.maxPerIP {
+		return errors.New("too many connections from " + ip)
+	}
+	t.perIP[ip]++
+	t.conns[conn] = ip
+	t.waiting[conn] = true
+	t.wg.Add(1)
+	return nil
+}
+
+func (t *connTracker) remove(conn net.Conn) {
+	t.mutex.Lock()
+	ip := t.conns[conn]
+	delete(t.conns, conn)
+	delete(t.waiting, conn)
+	if t.perIP[ip]--; t.perIP[ip] <= 0 {
+		delete(t.perIP, ip)
+	}
+	t.mutex.Unlock()
+	t.wg.Done()
+}
+
+// setWaiting 标记连接是否在握手或等待下一个请求，关闭后返回 false。
+// 新登记的连接在握手，关闭时等待中的连接直接断开，不需要等到超时
+func (t *connTracker) setWaiting(conn net.Conn, waiting bool) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.closed {
+		return false
+	}
+	if _, ok := t.conns[conn]; ok {
+		t.waiting[conn] = waiting
+	}
+	return true
+}
+
+func (t *connTracker) len() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return len(t.conns)
+}
+
+// close 停止登记新的连接，返回 false 表示已经关闭过
+func (t *connTracker) close() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.closed || t.done == nil {
+		return false
+	}
+	t.closed = true
+	close(t.done)
+	for conn, waiting := range t.waiting {
+		if waiting {
+			_ = conn.Close()
+		}
+	}
+	return true
+}
+
+func (t *connTracker) closeAll() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for conn := range t.conns {
+		_ = conn.Close()
+	}
+}
+
+// accept 为每个本地连接启动一个 goroutine，名额用完时暂停 Accept，
+// Accept 出错时按指数退避重试，监听关闭后返回
+func (c *ProxyClient) accept() {
+	var delay time.Duration
+	for c.conns.acquire() {
+		conn, err := c.listener.Accept()
+		if err != nil {
+			c.conns.release()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; delay > maxAcceptDelay {
+				delay = maxAcceptDelay
+			}
+			dlog.Error("failed to accept local connection: %v, retrying in %v", err, delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		if err := c.conns.add(conn); err != nil {
+			c.conns.release()
+			dlog.Warn("refuse local connection: %s", err)
+			_ = conn.Close()
+			continue
+		}
+		dlog.Debug("local %s connected", conn.RemoteAddr().String())
+		go func() {
+			defer c.conns.release()
+			defer c.conns.remove(conn)
+			c.handleLocalConn(conn)
+		}()
+	}
+}
+
+// Close 停止监听以及规则监视、远程规则、节点检查和控制接口，断开还在握手和等待下一个请求的连接，
+// 然后等待正在转发的连接结束。ctx 结束时强制关闭剩余的连接并返回 ctx 的错误
+func (c *ProxyClient) Close(ctx context.Context) error {
+	if !c.conns.close() {
+		return nil
+	}
+	err := c.listener.Close()
+	if c.stopWatch != nil {
+		c.stopWatch()
+	}
+	if c.stopProviders != nil {
+		c.stopProviders()
+	}
+	if c.stopCheck != nil {
+		c.stopCheck()
+	}
+	if c.control != nil {
+		_ = c.control.Shutdown(ctx)
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		c.conns.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return err
+	case <-ctx.Done():
+		c.conns.closeAll()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,186 @@
+package client
+
+import (
+	"Draylix2/network"
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func listenClient(t *testing.T, maxConns, maxPerIP int) (*ProxyClient, string) {
+	c := NewProxyClient(&ProxyClientConfig{
+		LocalAddr:     "127.0.0.1:0",
+		StateFile:     filepath.Join(t.TempDir(), "state.json"),
+		MaxConns:      maxConns,
+		MaxConnsPerIP: maxPerIP,
+	})
+	if err := c.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Close(context.Background()) })
+	return c, c.listener.Addr().String()
+}
+
+func waitConns(t *testing.T, c *ProxyClient, n int) {
+	for i := 0; c.conns.len() != n; i++ {
+		if i > 100 {
+			t.Fatalf("%d connections, want %d", c.conns.len(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// greet 发送 SOCKS5 问候并在 timeout 内等待回复
+func greet(conn net.Conn, timeout time.Duration) error {
+	if _, err := conn.Write([]byte{5, 1, 0}); err != nil {
+		return err
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	_, err := io.ReadFull(conn, make([]byte, 2))
+	return err
+}
+
+func TestMaxConnsPerIP(t *testing.T) {
+	c, addr := listenClient(t, 0, 1)
+	first, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	waitConns(t, c, 1)
+
+	second, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	if err := greet(second, time.Second); err == nil {
+		t.Fatal("connection over the per-ip limit was served")
+	}
+	if err := greet(first, time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMaxConnsBackpressure(t *testing.T) {
+	c, addr := listenClient(t, 1, 0)
+	first, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitConns(t, c, 1)
+
+	// 名额用完时新连接留在监听队列中，等前一个连接结束后处理
+	second, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	if err := greet(second, 100*time.Millisecond); err == nil {
+		t.Fatal("connection over the limit was served")
+	}
+	first.Close()
+	_ = second.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(second, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	c, addr := listenClient(t, 0, 0)
+	if err := c.proxySelector.SetMode(network.ModeDirect); err != nil {
+		t.Fatal(err)
+	}
+	target := startEcho(t, "tcp4", "127.0.0.1:0").Addr().(*net.TCPAddr)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// 握手完成后正在转发的连接要等到 ctx 结束
+	_, _ = conn.Write([]byte{5, 1, 0, 5, 1, 0, 1, 127, 0, 0, 1, byte(target.Port >> 8), byte(target.Port)})
+	if _, err := io.ReadFull(conn, make([]byte, 12)); err != nil {
+		t.Fatal(err)
+	}
+	waitConns(t, c, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := c.Close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v", err)
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Error("listener still accepting after Close")
+	}
+	// 超时后剩余的连接被强制关闭
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("got %v, want EOF", err)
+	}
+	waitConns(t, c, 0)
+	if err := c.Close(context.Background()); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+}
+
+func TestCloseIdleHttp(t *testing.T) {
+	srv := newEchoHttpServer(t, "a")
+	c, addr := listenClient(t, 0, 0)
+	if err := c.proxySelector.SetMode(network.ModeDirect); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _ = io.WriteString(conn, "GET "+srv.URL+"/ HTTP/1.1\r\nHost: "+srv.Listener.Addr().String()+"\r\n\r\n")
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	// 保持的连接在等待下一个请求，Close 不需要等到超时
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := c.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Errorf("got %v, want EOF", err)
+	}
+}
+
+func TestCloseHandshaking(t *testing.T) {
+	c, addr := listenClient(t, 0, 0)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// 只发送了 SOCKS5 版本号，握手停在方法协商
+	_, _ = conn.Write([]byte{5})
+	waitConns(t, c, 1)
+
+	done := make(chan error, 1)
+	go func() { done <- c.Close(context.Background()) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close waits for a stalled handshake")
+	}
+	waitConns(t, c, 0)
+}
@@ -0,0 +1,110 @@
+package client
+
+import (
+	"Draylix2/dlog"
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+)
+
+type modeBody struct {
+	Mode string
+}
+
+type nodeBody struct {
+	Node string
+}
+
+// serveControl 在 ControlAddr 上提供控制接口：
+//
+//	GET /mode         当前路由模式
+//	PUT /mode         切换路由模式，请求体为 {"Mode":"global"}
+//	GET /rules/stats  规则命中统计
+//	GET /nodes        节点健康状态
+//	PUT /nodes        手动选择节点，请求体为 {"Node":"tokyo"}
+func (c *ProxyClient) serveControl() (*http.Server, error) {
+	listener, err := net.Listen("tcp", c.ClientConfig.ControlAddr)
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{Handler: c.controlHandler()}
+	go func() {
+		if err := server.Serve(listener); err != http.ErrServerClosed {
+			dlog.Error("control api stopped: %s", err)
+		}
+	}()
+	dlog.Info("control api is listening at %s", listener.Addr())
+	return server, nil
+}
+
+func (c *ProxyClient) controlHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mode", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodPost:
+			var body modeBody
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := c.SetMode(body.Mode); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		writeJson(w, modeBody{Mode: c.Mode()})
+	})
+	mux.HandleFunc("/rules/stats", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		writeJson(w, c.RuleStats())
+	})
+	mux.HandleFunc("/nodes", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodPost:
+			var body nodeBody
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := c.SelectNode(body.Node); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		writeJson(w, c.Nodes())
+	})
+	return c.controlAuth(mux)
+}
+
+// controlAuth 在设置了 ControlToken 时要求 Authorization: Bearer <token>
+func (c *ProxyClient) controlAuth(next http.Handler) http.Handler {
+	token := c.ClientConfig.ControlToken
+	if token == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, []byte("Bearer "+token)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJson(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,71 @@
+package client
+
+import (
+	"Draylix2/network"
+	"bufio"
+	"fmt"
+	"net"
+	"time"
+)
+
+// maxMethodLen 是最长的 HTTP 方法（OPTIONS、CONNECT）加上空格的长度
+const maxMethodLen = 8
+
+// handshakeTimeout 是判断代理协议并读完握手或第一个请求的时间
+var handshakeTimeout = 10 * time.Second
+
+var httpMethods = map[string]byte{
+	"CONNECT": network.HttpsProxy,
+	"GET":     network.HttpProxy,
+	"HEAD":    network.HttpProxy,
+	"POST":    network.HttpProxy,
+	"PUT":     network.HttpProxy,
+	"PATCH":   network.HttpProxy,
+	"DELETE":  network.HttpProxy,
+	"OPTIONS": network.HttpProxy,
+	"TRACE":   network.HttpProxy,
+}
+
+// detectProxyType 只窥视而不消费数据来判断代理协议，数据不够时继续等待直到超时。
+// 返回的 Reader 从连接开头读起，交给对应协议的处理函数。
+// 读超时保持到握手或第一个请求解析完成，由调用者清除
+func detectProxyType(conn net.Conn) (*bufio.Reader, byte, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	r := bufio.NewReader(conn)
+	proxyType, err := peekProxyType(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	return r, proxyType, nil
+}
+
+func peekProxyType(r *bufio.Reader) (byte, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return 0, err
+	}
+	b := first[0]
+	switch b {
+	case 5:
+		return network.Socks5Proxy, nil
+	case 4:
+		return network.Socks4Proxy, nil
+	}
+	for n := 1; n <= maxMethodLen; n++ {
+		p, err := r.Peek(n)
+		if err != nil {
+			return 0, err
+		}
+		c := p[n-1]
+		if c == ' ' {
+			if proxyType, ok := httpMethods[string(p[:n-1])]; ok {
+				return proxyType, nil
+			}
+			break
+		}
+		if c < 'A' || c > 'Z' {
+			break
+		}
+	}
+	return 0, fmt.Errorf("unknown proxy type (first byte 0x%02x)", b)
+}
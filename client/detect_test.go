@@ -0,0 +1,84 @@
+package client
+
+import (
+	"Draylix2/network"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDetectProxyType(t *testing.T) {
+	cases := []struct {
+		chunks    []string
+		proxyType byte
+		ok        bool
+	}{
+		{[]string{"\x05\x01\x00"}, network.Socks5Proxy, true},
+		{[]string{"\x04\x01\x00\x50"}, network.Socks4Proxy, true},
+		{[]string{"CON", "NE", "CT example.com:443 HTTP/1.1\r\n\r\n"}, network.HttpsProxy, true},
+		{[]string{"P", "ATCH http://example.com/ HTTP/1.1\r\n\r\n"}, network.HttpProxy, true},
+		{[]string{"OPTIONS * HTTP/1.1\r\n\r\n"}, network.HttpProxy, true},
+		{[]string{"CONNECTX example.com:443"}, 0, false},
+		{[]string{"\x16\x03\x01"}, 0, false},
+	}
+	for _, c := range cases {
+		local, remote := net.Pipe()
+		go func() {
+			for _, chunk := range c.chunks {
+				_, _ = io.WriteString(remote, chunk)
+			}
+			remote.Close()
+		}()
+		r, proxyType, err := detectProxyType(local)
+		if (err == nil) != c.ok || proxyType != c.proxyType {
+			t.Errorf("%q: got %d %v", c.chunks, proxyType, err)
+		}
+		if err == nil {
+			// 判断协议后数据保持完整
+			data, _ := io.ReadAll(r)
+			want := ""
+			for _, chunk := range c.chunks {
+				want += chunk
+			}
+			if string(data) != want {
+				t.Errorf("got %q, want %q", data, want)
+			}
+		}
+		local.Close()
+	}
+}
+
+func TestDetectProxyTypeTimeout(t *testing.T) {
+	timeout := handshakeTimeout
+	handshakeTimeout = 50 * time.Millisecond
+	defer func() { handshakeTimeout = timeout }()
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+	go func() { _, _ = io.WriteString(remote, "GE") }()
+	if _, _, err := detectProxyType(local); err == nil {
+		t.Fatal("expected timeout")
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	timeout := handshakeTimeout
+	handshakeTimeout = 50 * time.Millisecond
+	defer func() { handshakeTimeout = timeout }()
+
+	local := startLocalProxy(t, nil)
+	// 协议已经判断出来，但握手或第一个请求没有发完
+	for _, partial := range []string{"\x05", "\x05\x01\x00\x05\x01", "\x04\x01\x00\x50", "GET http://x/ HTTP/1.1\r\n", "CONNECT x:443 HTTP/1.1\r\n"} {
+		conn, err := net.Dial("tcp", local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = io.WriteString(conn, partial)
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := io.ReadAll(conn); err != nil {
+			t.Errorf("%q: connection not closed: %v", partial, err)
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,26 @@
+package client
+
+import (
+	"Draylix2/dlog"
+	"Draylix2/network"
+)
+
+// loadHosts 合并配置中的 Hosts 和 HostsFiles，配置中的条目优先，文件按顺序先出现的优先
+func (c *ProxyClient) loadHosts() (*network.Hosts, error) {
+	hosts := network.NewHosts()
+	for name, ip := range c.ClientConfig.Hosts {
+		if err := hosts.Add(name, ip); err != nil {
+			return nil, err
+		}
+	}
+	for _, file := range c.ClientConfig.HostsFiles {
+		skipped, err := hosts.LoadHostsFile(file)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range skipped {
+			dlog.Warn("skip hosts entry %s", e)
+		}
+	}
+	return hosts, nil
+}
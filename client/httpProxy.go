@@ -0,0 +1,258 @@
+package client
+
+import (
+	"Draylix2/dlog"
+	"Draylix2/network"
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// hopHeaders 是只在一跳内有效的头部，转发前删除
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// httpUpstream 是普通 HTTP 代理当前复用的目标连接
+type httpUpstream struct {
+	addr   string
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// httpKeepAliveTimeout 是保持的本地连接等待下一个请求的最长时间
+const httpKeepAliveTimeout = time.Minute
+
+// bufferedConn 先读出 bufio.Reader 中已经缓冲的数据
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+// serveHttp 逐个处理普通 HTTP 代理请求。每个请求按自己的目标选择路由，
+// 目标不变时复用上游连接，本地连接在客户端和服务器都允许时保持。
+// 本地连接的流量和空闲、时长限制与其他代理类型一样由 Relay 统计
+func (c *ProxyClient) serveHttp(conn net.Conn, r *bufio.Reader) {
+	relay := c.newRelay(conn.RemoteAddr().String())
+	local, stop := relay.Meter(&bufferedConn{Conn: conn, r: r})
+	defer stop()
+	r = bufio.NewReader(local)
+	var up *httpUpstream
+	defer func() {
+		if up != nil {
+			_ = up.conn.Close()
+		}
+	}()
+
+	keepAlive := httpKeepAliveTimeout
+	if idle := c.ClientConfig.IdleTimeout; idle > 0 && idle < keepAlive {
+		keepAlive = idle
+	}
+	for first := true; ; first = false {
+		if !first {
+			// 等待下一个请求时设置超时，关闭客户端时直接断开
+			if !c.conns.setWaiting(conn, true) {
+				return
+			}
+			_ = conn.SetReadDeadline(time.Now().Add(keepAlive))
+		}
+		req, err := http.ReadRequest(r)
+		// 第一个请求的超时是 detectProxyType 设置的握手超时
+		_ = conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			if err != io.EOF {
+				dlog.Debug("failed to read http request: %s", err)
+			}
+			return
+		}
+		if !c.conns.setWaiting(conn, false) {
+			return
+		}
+		if !c.checkProxyAuth(req) {
+			_, _ = io.Copy(io.Discard, req.Body)
+			if err := writeProxyAuthRequired(local, req.Close); err != nil || req.Close {
+				return
+			}
+			continue
+		}
+		addr, addrType := parsHttpAddr(req)
+		if up == nil || up.addr != addr {
+			if up != nil {
+				_ = up.conn.Close()
+				up = nil
+			}
+			remote, err := c.dialHttp(local, addr, addrType)
+			if err == network.ErrPolicyReject || err == network.ErrPolicyDrop {
+				return
+			}
+			if err != nil {
+				dlog.Error("failed to connect to %s : %s", addr, err)
+				status, reason := httpFailure(err)
+				_ = writeHttpError(local, status, reason)
+				return
+			}
+			up = &httpUpstream{addr: addr, conn: remote, reader: bufio.NewReader(remote)}
+		}
+
+		upgrade := isUpgrade(req.Header)
+		removeHopHeaders(req.Header, upgrade)
+		if _, ok := req.Header["User-Agent"]; !ok {
+			// 避免 Request.Write 加上默认的 User-Agent
+			req.Header["User-Agent"] = []string{""}
+		}
+		if err := req.Write(up.conn); err != nil {
+			dlog.Error("failed to forward request to %s : %s", addr, err)
+			_ = writeHttpError(local, http.StatusBadGateway, "failed to forward request")
+			return
+		}
+		resp, err := http.ReadResponse(up.reader, req)
+		for err == nil && resp.StatusCode < 200 && resp.StatusCode != http.StatusSwitchingProtocols {
+			// 100 Continue 等中间响应直接转发
+			if err = resp.Write(local); err != nil {
+				return
+			}
+			resp, err = http.ReadResponse(up.reader, req)
+		}
+		if err != nil {
+			dlog.Error("failed to read response from %s : %s", addr, err)
+			_ = writeHttpError(local, http.StatusBadGateway, "invalid response from target")
+			return
+		}
+
+		if resp.StatusCode == http.StatusSwitchingProtocols && upgrade {
+			if err := resp.Write(local); err == nil {
+				c.tunnelUpgraded(&bufferedConn{Conn: conn, r: r}, up, stop().Duration)
+			}
+			return
+		}
+		upstreamClosed := resp.Close
+		removeHopHeaders(resp.Header, false)
+		// 没有长度的响应体读到上游关闭为止，本地连接也只能在之后关闭
+		resp.Close = req.Close || untilClose(req, resp)
+		err = resp.Write(local)
+		_ = resp.Body.Close()
+		if err != nil || resp.Close {
+			return
+		}
+		if upstreamClosed {
+			_ = up.conn.Close()
+			up = nil
+		}
+	}
+}
+
+func untilClose(req *http.Request, resp *http.Response) bool {
+	if req.Method == http.MethodHead || resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		return false
+	}
+	return resp.ContentLength < 0 && len(resp.TransferEncoding) == 0
+}
+
+func (c *ProxyClient) dialHttp(conn net.Conn, addr string, addrType byte) (net.Conn, error) {
+	info := &network.ProxyInfo{
+		ProxyType: network.HttpProxy,
+		AddrType:  addrType,
+		Addr:      addr,
+		Source:    conn.RemoteAddr().String(),
+	}
+	return c.proxySelector.Select(c.dialServer, conn, info)
+}
+
+// tunnelUpgraded 在协议升级（例如 WebSocket）后用 Relay 双向转发原始数据，
+// elapsed 是升级前已经用掉的连接时长
+func (c *ProxyClient) tunnelUpgraded(local net.Conn, up *httpUpstream, elapsed time.Duration) {
+	relay := c.newRelay(up.addr)
+	if relay.MaxLifetime > 0 {
+		if relay.MaxLifetime -= elapsed; relay.MaxLifetime <= 0 {
+			return
+		}
+	}
+	relay.Run(local, &bufferedConn{Conn: up.conn, r: up.reader})
+}
+
+func isUpgrade(header http.Header) bool {
+	return headerHasToken(header, "Connection", "upgrade") && header.Get("Upgrade") != ""
+}
+
+// removeHopHeaders 删除逐跳头部以及 Connection 中列出的头部，keepUpgrade 为 true 时保留升级请求需要的头部
+func removeHopHeaders(header http.Header, keepUpgrade bool) {
+	for _, v := range header.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			name = textproto.TrimString(name)
+			if name != "" && !(keepUpgrade && strings.EqualFold(name, "Upgrade")) {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		if keepUpgrade && (name == "Connection" || name == "Upgrade") {
+			continue
+		}
+		header.Del(name)
+	}
+	if keepUpgrade {
+		header.Set("Connection", "Upgrade")
+	}
+}
+
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, v := range header.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(textproto.TrimString(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeHttpError 回复错误状态并关闭连接，reason 作为简短的说明放在响应体中
+func writeHttpError(conn net.Conn, status int, reason string) error {
+	body := fmt.Sprintf("%d %s\n%s\n", status, http.StatusText(status), reason)
+	_, err := fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Type: text/plain\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+		status, http.StatusText(status), len(body), body)
+	return err
+}
+
+// httpFailure 把连接目标时的错误转换为 HTTP 状态码和说明，规则拒绝的 403 由 PolicySelector 回复
+func httpFailure(err error) (int, string) {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, network.ErrServerUnavailable):
+		return http.StatusServiceUnavailable, "proxy server unavailable"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return http.StatusGatewayTimeout, "connection to target timed out"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return http.StatusBadGateway, "connection refused by target"
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr):
+		return http.StatusBadGateway, "target unreachable"
+	}
+	return http.StatusBadGateway, "failed to connect to target"
+}
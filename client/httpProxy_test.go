@@ -0,0 +1,207 @@
+package client
+
+import (
+	"Draylix2/network"
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newEchoHttpServer(t *testing.T, name string) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s %s proxy=%q private=%q ua=%q",
+			name, r.Method, r.RequestURI, r.Header.Get("Proxy-Connection")+r.Header.Get("Proxy-Authorization"),
+			r.Header.Get("X-Private"), r.Header.Get("User-Agent"))
+		if len(body) > 0 {
+			fmt.Fprintf(w, " body=%s", body)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestHttpProxyKeepAlive(t *testing.T) {
+	a := newEchoHttpServer(t, "a")
+	b := newEchoHttpServer(t, "b")
+	conn, err := net.Dial("tcp", startLocalProxy(t, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	cases := []struct {
+		request string
+		want    string
+	}{
+		{"GET " + a.URL + "/one?x=1 HTTP/1.1\r\nHost: " + a.Listener.Addr().String() +
+			"\r\nProxy-Connection: keep-alive\r\nProxy-Authorization: Basic eA==\r\nConnection: keep-alive, X-Private\r\nX-Private: 1\r\n\r\n",
+			`a GET /one?x=1 proxy="" private="" ua=""`},
+		{"POST " + b.URL + "/two HTTP/1.1\r\nHost: " + b.Listener.Addr().String() + "\r\nUser-Agent: test\r\nContent-Length: 5\r\n\r\nhello",
+			`b POST /two proxy="" private="" ua="test" body=hello`},
+		{"GET " + a.URL + "/three HTTP/1.1\r\nHost: " + a.Listener.Addr().String() + "\r\n\r\n",
+			`a GET /three proxy="" private="" ua=""`},
+	}
+	for _, c := range cases {
+		if _, err := io.WriteString(conn, c.request); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != c.want {
+			t.Errorf("got %q, want %q", body, c.want)
+		}
+		if resp.Close {
+			t.Fatal("proxy closed the keep-alive connection")
+		}
+	}
+}
+
+func TestHttpProxyTraffic(t *testing.T) {
+	a := newEchoHttpServer(t, "a")
+	c := NewProxyClient(&ProxyClientConfig{StateFile: filepath.Join(t.TempDir(), "state.json")})
+	if err := c.proxySelector.SetMode(network.ModeDirect); err != nil {
+		t.Fatal(err)
+	}
+	var up, down atomic.Int64
+	c.OnTraffic = func(isUp bool, n int64) {
+		if isUp {
+			up.Add(n)
+		} else {
+			down.Add(n)
+		}
+	}
+	conn, err := net.Dial("tcp", serveLocal(t, c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	request := "GET " + a.URL + "/ HTTP/1.1\r\nHost: " + a.Listener.Addr().String() + "\r\n\r\n"
+	r := bufio.NewReader(conn)
+	received := 0
+	for i := 0; i < 2; i++ {
+		_, _ = io.WriteString(conn, request)
+		resp, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		received += len(body)
+	}
+	// 计数在写完响应后增加，与客户端读完响应之间没有先后保证
+	for i := 0; up.Load() != int64(2*len(request)) || down.Load() <= int64(received); i++ {
+		if i > 100 {
+			t.Fatalf("up %d, down %d", up.Load(), down.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHttpProxyUpgrade(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		req, err := http.ReadRequest(r)
+		if err != nil || req.Header.Get("Upgrade") != "echo" {
+			return
+		}
+		_, _ = io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		_, _ = io.Copy(conn, r)
+	}()
+
+	conn, err := net.Dial("tcp", startLocalProxy(t, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	addr := listener.Addr().String()
+	_, _ = io.WriteString(conn, "GET http://"+addr+"/ws HTTP/1.1\r\nHost: "+addr+"\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got %v %v", resp, err)
+	}
+	_, _ = io.WriteString(conn, "frame")
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(r, buf); err != nil || string(buf) != "frame" {
+		t.Fatalf("got %q %v", buf, err)
+	}
+}
+
+func TestHttpProxyErrors(t *testing.T) {
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := closed.Addr().String()
+	closed.Close()
+
+	rules := NewProxyClient(&ProxyClientConfig{StateFile: filepath.Join(t.TempDir(), "state.json")})
+	if err := rules.proxySelector.SetPolicies([]*network.Policy{
+		{Type: network.DomainPolicy, Value: ".blocked.test", Action: network.ActionReject},
+		{Type: network.MatchPolicy, IsProxy: network.Direct},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// 代理服务器不可用时不能把错误当作目标的错误
+	unavailable := NewProxyClient(&ProxyClientConfig{ServerAddr: addr, StateFile: filepath.Join(t.TempDir(), "state.json")})
+	if err := unavailable.proxySelector.SetMode(network.ModeGlobal); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name    string
+		local   string
+		request string
+		status  int
+		body    string
+	}{
+		{"refused", startLocalProxy(t, nil), "GET http://" + addr + "/ HTTP/1.1\r\nHost: " + addr + "\r\n\r\n",
+			http.StatusBadGateway, "connection refused by target"},
+		{"connect refused", startLocalProxy(t, nil), "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n\r\n",
+			http.StatusBadGateway, "connection refused by target"},
+		{"rejected", serveLocal(t, rules), "GET http://www.blocked.test/ HTTP/1.1\r\nHost: www.blocked.test\r\n\r\n",
+			http.StatusForbidden, "blocked by proxy rules"},
+		{"server unavailable", serveLocal(t, unavailable), "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n",
+			http.StatusServiceUnavailable, "proxy server unavailable"},
+	}
+	for _, c := range cases {
+		conn, err := net.Dial("tcp", c.local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = io.WriteString(conn, c.request)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		conn.Close()
+		if err != nil || resp.StatusCode != c.status || !resp.Close || !strings.Contains(string(body), c.body) {
+			t.Errorf("%s: got %d, close %v, body %q, %v", c.name, resp.StatusCode, resp.Close, body, err)
+		}
+	}
+}
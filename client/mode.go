@@ -0,0 +1,85 @@
+package client
+
+import (
+	"Draylix2/dlog"
+	"Draylix2/network"
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// clientState 是需要在重启后保留的运行状态
+type clientState struct {
+	Mode string
+	// Node 是手动选择的节点，为空表示使用配置的策略
+	Node string `json:",omitempty"`
+}
+
+func (c *ProxyClient) stateFile() string {
+	if c.ClientConfig.StateFile != "" {
+		return c.ClientConfig.StateFile
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "draylix", "state.json")
+}
+
+// loadState 恢复上次保存的路由模式和手动选择的节点，文件不存在时使用 rule 模式
+func (c *ProxyClient) loadState() {
+	file := c.stateFile()
+	if file == "" {
+		return
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return
+	}
+	var state clientState
+	if err := json.Unmarshal(data, &state); err != nil {
+		dlog.Warn("cannot parse state file %s: %s", file, err)
+		return
+	}
+	if state.Mode != "" {
+		if err := c.proxySelector.SetMode(state.Mode); err != nil {
+			dlog.Warn("cannot restore routing mode: %s", err)
+		}
+	}
+	if state.Node != "" && c.nodes.find(state.Node) != nil {
+		c.nodes.strategy, c.nodes.selected = StrategyManual, state.Node
+	}
+}
+
+func (c *ProxyClient) saveState() error {
+	file := c.stateFile()
+	if file == "" {
+		return nil
+	}
+	data, err := json.Marshal(clientState{Mode: c.Mode(), Node: c.selectedNode()})
+	if err != nil {
+		return err
+	}
+	return network.WriteFileAtomic(file, data)
+}
+
+// SetMode 切换路由模式（rule、global、direct），新连接立即生效，并保存到状态文件
+func (c *ProxyClient) SetMode(mode string) error {
+	c.modeMutex.Lock()
+	defer c.modeMutex.Unlock()
+	if err := c.proxySelector.SetMode(mode); err != nil {
+		return err
+	}
+	dlog.Info("routing mode: %s", mode)
+	if c.OnModeChange != nil {
+		c.OnModeChange(mode)
+	}
+	if err := c.saveState(); err != nil {
+		dlog.Warn("cannot save routing mode: %s", err)
+	}
+	return nil
+}
+
+func (c *ProxyClient) Mode() string {
+	return c.proxySelector.Mode()
+}
@@ -0,0 +1,66 @@
+package client
+
+import (
+	"Draylix2/network"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestModePersisted(t *testing.T) {
+	config := &ProxyClientConfig{StateFile: filepath.Join(t.TempDir(), "state.json")}
+	c := NewProxyClient(config)
+	if c.Mode() != network.ModeRule {
+		t.Fatalf("default mode %s", c.Mode())
+	}
+	if err := c.SetMode("bogus"); err == nil {
+		t.Fatal("expected error for unknown mode")
+	}
+	if err := c.SetMode(network.ModeGlobal); err != nil {
+		t.Fatal(err)
+	}
+	if mode := NewProxyClient(config).Mode(); mode != network.ModeGlobal {
+		t.Fatalf("mode after restart: %s", mode)
+	}
+}
+
+func TestControlMode(t *testing.T) {
+	c := NewProxyClient(&ProxyClientConfig{StateFile: filepath.Join(t.TempDir(), "state.json"), ControlToken: "secret"})
+	var changed string
+	c.OnModeChange = func(mode string) { changed = mode }
+	srv := httptest.NewServer(c.controlHandler())
+	defer srv.Close()
+
+	do := func(method, body, token string) (int, string) {
+		req, _ := http.NewRequest(method, srv.URL+"/mode", strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, strings.TrimSpace(string(b))
+	}
+
+	if code, _ := do(http.MethodGet, "", ""); code != http.StatusUnauthorized {
+		t.Errorf("without token: %d", code)
+	}
+	if code, body := do(http.MethodPut, `{"Mode":"direct"}`, "secret"); code != http.StatusOK || body != `{"Mode":"direct"}` {
+		t.Errorf("put: %d %s", code, body)
+	}
+	if c.Mode() != network.ModeDirect || changed != network.ModeDirect {
+		t.Errorf("mode %s, notified %s", c.Mode(), changed)
+	}
+	if code, _ := do(http.MethodPut, `{"Mode":"fast"}`, "secret"); code != http.StatusBadRequest {
+		t.Errorf("invalid mode: %d", code)
+	}
+	if code, body := do(http.MethodGet, "", "secret"); code != http.StatusOK || body != `{"Mode":"direct"}` {
+		t.Errorf("get: %d %s", code, body)
+	}
+}
@@ -0,0 +1,280 @@
+package client
+
+import (
+	"Draylix2/dlog"
+	"Draylix2/network"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 选择默认节点的策略
+const (
+	// StrategyManual 只使用手动选择的节点
+	StrategyManual = "manual"
+	// StrategyLatency 优先使用健康检查延迟最低的节点
+	StrategyLatency = "latency"
+	// StrategyRoundRobin 在可用节点之间轮流使用
+	StrategyRoundRobin = "round-robin"
+	// StrategyFailover 按配置顺序使用第一个可用节点
+	StrategyFailover = "failover"
+)
+
+const (
+	// DefaultNodeName 是 ServerAddr 对应的节点名
+	DefaultNodeName            = "default"
+	defaultHealthCheckInterval = time.Minute
+)
+
+var errNoServer = errors.New("no server configured")
+
+type nodeState struct {
+	ServerConfig
+	alive atomic.Bool
+	// rtt 是最近一次建立隧道（TCP+TLS+认证）的耗时，0 表示还没有测量
+	rtt atomic.Int64
+}
+
+func (n *nodeState) report(rtt time.Duration, err error) {
+	n.alive.Store(err == nil)
+	if err == nil {
+		n.rtt.Store(int64(rtt))
+	}
+}
+
+// NodeStatus 是一个节点的健康状态
+type NodeStatus struct {
+	Name   string
+	Addr   string
+	Alive  bool
+	RTT    time.Duration
+	Active bool
+}
+
+// nodePool 按策略给出连接默认节点时尝试的顺序，失败的节点排到最后
+type nodePool struct {
+	mutex    sync.Mutex
+	nodes    []*nodeState
+	strategy string
+	selected string
+	active   string
+	next     atomic.Uint64
+}
+
+func newNodePool(config *ProxyClientConfig) *nodePool {
+	pool := &nodePool{strategy: config.NodeStrategy, selected: config.Node}
+	if config.ServerAddr != "" {
+		pool.add(ServerConfig{Name: DefaultNodeName, Addr: config.ServerAddr, UserId: config.UserId, Passwd: config.Passwd})
+	}
+	for _, s := range config.Servers {
+		pool.add(s)
+	}
+	switch pool.strategy {
+	case "":
+		pool.strategy = StrategyFailover
+	case StrategyManual, StrategyLatency, StrategyRoundRobin, StrategyFailover:
+	default:
+		dlog.Warn("unknown node strategy %s, using %s", pool.strategy, StrategyFailover)
+		pool.strategy = StrategyFailover
+	}
+	if pool.find(pool.selected) == nil && len(pool.nodes) > 0 {
+		pool.selected = pool.nodes[0].Name
+	}
+	return pool
+}
+
+func (p *nodePool) add(s ServerConfig) {
+	n := &nodeState{ServerConfig: s}
+	n.alive.Store(true)
+	p.nodes = append(p.nodes, n)
+}
+
+func (p *nodePool) names() []string {
+	names := make([]string, len(p.nodes))
+	for i, n := range p.nodes {
+		names[i] = n.Name
+	}
+	return names
+}
+
+func (p *nodePool) find(name string) *nodeState {
+	for _, n := range p.nodes {
+		if n.Name == name {
+			return n
+		}
+	}
+	return nil
+}
+
+func (p *nodePool) candidates() []*nodeState {
+	p.mutex.Lock()
+	strategy, selected := p.strategy, p.selected
+	p.mutex.Unlock()
+	if strategy == StrategyManual {
+		if n := p.find(selected); n != nil {
+			return []*nodeState{n}
+		}
+		return nil
+	}
+
+	var alive, dead []*nodeState
+	for _, n := range p.nodes {
+		if n.alive.Load() {
+			alive = append(alive, n)
+		} else {
+			dead = append(dead, n)
+		}
+	}
+	switch strategy {
+	case StrategyLatency:
+		// 没有测量过的节点排在已测量的节点之后
+		sort.SliceStable(alive, func(i, j int) bool {
+			a, b := alive[i].rtt.Load(), alive[j].rtt.Load()
+			return a != 0 && (b == 0 || a < b)
+		})
+	case StrategyRoundRobin:
+		if len(alive) > 0 {
+			k := int(p.next.Add(1)-1) % len(alive)
+			alive = append(alive[k:len(alive):len(alive)], alive[:k]...)
+		}
+	}
+	return append(alive, dead...)
+}
+
+// setActive 记录当前使用的节点，返回节点是否变化
+func (p *nodePool) setActive(name string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.active == name {
+		return false
+	}
+	p.active = name
+	return true
+}
+
+// dialServer 连接指定名称的节点，名称为空时按策略连接默认节点，失败时依次尝试其他节点
+func (c *ProxyClient) dialServer(node string) (net.Conn, error) {
+	if node != "" {
+		n := c.nodes.find(node)
+		if n == nil {
+			return nil, fmt.Errorf("unknown node %s", node)
+		}
+		return c.dialNode(n)
+	}
+	err := errNoServer
+	for _, n := range c.nodes.candidates() {
+		var conn net.Conn
+		conn, err = c.dialNode(n)
+		if err == nil {
+			c.setActiveNode(n.Name)
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+func (c *ProxyClient) dialNode(n *nodeState) (net.Conn, error) {
+	start := time.Now()
+	conn, err := network.DialDraylixOverTls(n.UserId, n.Passwd, n.Addr, c.ClientConfig.TlsConfig)
+	n.report(time.Since(start), err)
+	if err != nil {
+		dlog.Warn("node %s (%s) is unavailable: %s", n.Name, n.Addr, err)
+		return nil, fmt.Errorf("node %s: %w", n.Name, err)
+	}
+	return conn, nil
+}
+
+func (c *ProxyClient) setActiveNode(name string) {
+	if !c.nodes.setActive(name) {
+		return
+	}
+	dlog.Info("using node %s", name)
+	if c.OnNodeChange != nil {
+		c.OnNodeChange(name)
+	}
+}
+
+// checkNodes 同时检查所有节点，然后把策略选出的首选节点作为当前节点
+func (c *ProxyClient) checkNodes() {
+	var wg sync.WaitGroup
+	for _, n := range c.nodes.nodes {
+		wg.Add(1)
+		go func(n *nodeState) {
+			defer wg.Done()
+			if conn, err := c.dialNode(n); err == nil {
+				_ = conn.Close()
+			}
+		}(n)
+	}
+	wg.Wait()
+	if candidates := c.nodes.candidates(); len(candidates) > 0 && candidates[0].alive.Load() {
+		c.setActiveNode(candidates[0].Name)
+	}
+}
+
+// startHealthCheck 定期建立一次隧道检查每个节点，返回的函数用于停止检查
+func (c *ProxyClient) startHealthCheck(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			c.checkNodes()
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// Nodes 返回所有节点的健康状态
+func (c *ProxyClient) Nodes() []NodeStatus {
+	c.nodes.mutex.Lock()
+	active := c.nodes.active
+	c.nodes.mutex.Unlock()
+	status := make([]NodeStatus, len(c.nodes.nodes))
+	for i, n := range c.nodes.nodes {
+		status[i] = NodeStatus{
+			Name:   n.Name,
+			Addr:   n.Addr,
+			Alive:  n.alive.Load(),
+			RTT:    time.Duration(n.rtt.Load()),
+			Active: n.Name == active,
+		}
+	}
+	return status
+}
+
+// SelectNode 切换到 manual 策略并使用指定的节点，保存到状态文件
+func (c *ProxyClient) SelectNode(name string) error {
+	if c.nodes.find(name) == nil {
+		return fmt.Errorf("unknown node %s", name)
+	}
+	c.nodes.mutex.Lock()
+	c.nodes.strategy, c.nodes.selected = StrategyManual, name
+	c.nodes.mutex.Unlock()
+	c.setActiveNode(name)
+	c.modeMutex.Lock()
+	defer c.modeMutex.Unlock()
+	if err := c.saveState(); err != nil {
+		dlog.Warn("cannot save node: %s", err)
+	}
+	return nil
+}
+
+// selectedNode 返回 manual 策略下选择的节点，其他策略返回空
+func (c *ProxyClient) selectedNode() string {
+	c.nodes.mutex.Lock()
+	defer c.nodes.mutex.Unlock()
+	if c.nodes.strategy != StrategyManual {
+		return ""
+	}
+	return c.nodes.selected
+}
@@ -0,0 +1,138 @@
+package client
+
+import (
+	"Draylix2/network"
+	"crypto/tls"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// startDraylixServer 启动一个连接目标后转发数据的隧道服务器，返回监听地址
+func startDraylixServer(t *testing.T) string {
+	cert, err := tls.LoadX509KeyPair("../server-cert.pem", "../server-key.pem")
+	if err != nil {
+		t.Skip(err)
+	}
+	listener, err := network.ListenDraylixOverTls("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}},
+		&network.DraylixConfig{
+			GetPasswd:           func(string) (string, error) { return "secret", nil },
+			HandleInvalidAccess: func(conn net.Conn) { conn.Close() },
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if _, ok := err.(net.Error); ok {
+					return
+				}
+				continue
+			}
+			go func() {
+				target, _, err := network.HandleConnect(conn)
+				if err != nil {
+					conn.Close()
+					return
+				}
+				(&network.Relay{}).Run(conn, target)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func candidateNames(p *nodePool) []string {
+	var names []string
+	for _, n := range p.candidates() {
+		names = append(names, n.Name)
+	}
+	return names
+}
+
+func TestNodeFailover(t *testing.T) {
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := closed.Addr().String()
+	closed.Close()
+
+	var changed []string
+	c := NewProxyClient(&ProxyClientConfig{
+		ServerAddr: dead, UserId: "u", Passwd: "secret",
+		Servers:   []ServerConfig{{Name: "backup", Addr: startDraylixServer(t), UserId: "u", Passwd: "secret"}},
+		StateFile: filepath.Join(t.TempDir(), "state.json"),
+		TlsConfig: &tls.Config{InsecureSkipVerify: true},
+	})
+	c.OnNodeChange = func(node string) { changed = append(changed, node) }
+
+	conn, err := c.dialServer("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if !reflect.DeepEqual(changed, []string{"backup"}) {
+		t.Errorf("node changes: %v", changed)
+	}
+	if got := candidateNames(c.nodes); !reflect.DeepEqual(got, []string{"backup", DefaultNodeName}) {
+		t.Errorf("dead node was not moved to the end: %v", got)
+	}
+	status := c.Nodes()
+	if status[0].Alive || !status[1].Alive || !status[1].Active || status[1].RTT == 0 {
+		t.Errorf("status: %+v", status)
+	}
+	if _, err := c.dialServer("nope"); err == nil {
+		t.Error("expected error for unknown node")
+	}
+}
+
+func TestNodeStrategies(t *testing.T) {
+	config := &ProxyClientConfig{Servers: []ServerConfig{{Name: "a"}, {Name: "b"}, {Name: "c"}, {Name: "d"}}}
+
+	config.NodeStrategy = StrategyLatency
+	pool := newNodePool(config)
+	pool.nodes[0].report(30*time.Millisecond, nil)
+	pool.nodes[1].report(10*time.Millisecond, nil)
+	pool.nodes[3].report(0, net.ErrClosed)
+	if got := candidateNames(pool); !reflect.DeepEqual(got, []string{"b", "a", "c", "d"}) {
+		t.Errorf("latency: %v", got)
+	}
+
+	config.NodeStrategy = StrategyRoundRobin
+	pool = newNodePool(config)
+	pool.nodes[3].report(0, net.ErrClosed)
+	for _, first := range []string{"a", "b", "c", "a"} {
+		if got := candidateNames(pool); got[0] != first || got[3] != "d" {
+			t.Errorf("round-robin: got %v, want %s first", got, first)
+		}
+	}
+
+	config.NodeStrategy, config.Node = StrategyManual, "c"
+	if got := candidateNames(newNodePool(config)); !reflect.DeepEqual(got, []string{"c"}) {
+		t.Errorf("manual: %v", got)
+	}
+}
+
+func TestSelectNodePersisted(t *testing.T) {
+	config := &ProxyClientConfig{
+		Servers:   []ServerConfig{{Name: "a"}, {Name: "b"}},
+		StateFile: filepath.Join(t.TempDir(), "state.json"),
+	}
+	c := NewProxyClient(config)
+	if err := c.SelectNode("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SelectNode("nope"); err == nil {
+		t.Error("expected error for unknown node")
+	}
+	restored := NewProxyClient(config)
+	if got := candidateNames(restored.nodes); !reflect.DeepEqual(got, []string{"b"}) {
+		t.Errorf("restored: %v", got)
+	}
+}
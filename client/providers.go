@@ -0,0 +1,113 @@
+package client
+
+import (
+	"Draylix2/dlog"
+	"Draylix2/network"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const providerFetchTimeout = 30 * time.Second
+
+// providerSources 返回已经有缓存的规则提供者，还没下载过的暂时跳过
+func (c *ProxyClient) providerSources() []network.PolicySource {
+	var sources []network.PolicySource
+	for i := range c.ClientConfig.RuleProviders {
+		rp := &c.ClientConfig.RuleProviders[i]
+		if _, err := os.Stat(rp.CacheFile); err != nil {
+			continue
+		}
+		sources = append(sources, rp.Source())
+	}
+	return sources
+}
+
+// checkProviderName 要求名称非空、不重复，并且可以直接作为缓存目录下的文件名
+func checkProviderName(name string, seen map[string]bool) error {
+	switch {
+	case name == "", name == ".", name == "..":
+		return fmt.Errorf("invalid rule provider name %q", name)
+	case strings.ContainsAny(name, `/\`):
+		return fmt.Errorf("rule provider name %q contains a path separator", name)
+	case seen[name]:
+		return fmt.Errorf("duplicate rule provider name %q", name)
+	}
+	seen[name] = true
+	return nil
+}
+
+// validProviders 去掉名称无效的规则提供者
+func validProviders(providers []network.RuleProvider) []network.RuleProvider {
+	seen := make(map[string]bool)
+	valid := providers[:0:0]
+	for _, rp := range providers {
+		if err := checkProviderName(rp.Name, seen); err != nil {
+			dlog.Error("skip rule provider %s: %s", rp.URL, err)
+			continue
+		}
+		valid = append(valid, rp)
+	}
+	return valid
+}
+
+func defaultProviderCache(name string) string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "draylix", "providers", name)
+}
+
+func (c *ProxyClient) providerHttpClient(rp *network.RuleProvider) *http.Client {
+	transport := &http.Transport{Proxy: nil}
+	if rp.ViaTunnel {
+		transport.DialContext = func(ctx context.Context, _, addr string) (net.Conn, error) {
+			return network.DialTunnel(c.dialServer, "", addr)
+		}
+	}
+	return &http.Client{Transport: transport, Timeout: providerFetchTimeout}
+}
+
+// RefreshProvider 下载一个规则提供者，内容有变化时重新加载规则
+func (c *ProxyClient) RefreshProvider(rp *network.RuleProvider) error {
+	err := rp.Fetch(c.providerHttpClient(rp))
+	if err == network.ErrNotModified {
+		dlog.Debug("rule provider %s is up to date", rp.Name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	dlog.Info("rule provider %s updated", rp.Name)
+	return c.Reload()
+}
+
+// startProviders 为每个规则提供者启动刷新协程，返回的函数用于停止
+func (c *ProxyClient) startProviders() (stop func()) {
+	done := make(chan struct{})
+	for i := range c.ClientConfig.RuleProviders {
+		rp := &c.ClientConfig.RuleProviders[i]
+		go func() {
+			for {
+				if err := c.RefreshProvider(rp); err != nil {
+					dlog.Warn("failed to refresh rule provider %s, using cache: %s", rp.Name, err)
+				}
+				if rp.Interval <= 0 {
+					return
+				}
+				select {
+				case <-done:
+					return
+				case <-time.After(rp.Interval):
+				}
+			}
+		}()
+	}
+	return func() { close(done) }
+}
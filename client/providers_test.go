@@ -0,0 +1,20 @@
+package client
+
+import (
+	"Draylix2/network"
+	"reflect"
+	"testing"
+)
+
+func TestValidProviders(t *testing.T) {
+	providers := []network.RuleProvider{
+		{Name: "ads"}, {Name: ""}, {Name: ".."}, {Name: "../ads"}, {Name: `a\b`}, {Name: "ads"}, {Name: "cn"},
+	}
+	var names []string
+	for _, rp := range validProviders(providers) {
+		names = append(names, rp.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"ads", "cn"}) {
+		t.Errorf("got %q", names)
+	}
+}
@@ -0,0 +1,48 @@
+package client
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// maxConnectAuthAttempts 是同一个连接上 CONNECT 认证失败后允许重试的次数
+const maxConnectAuthAttempts = 3
+
+const proxyAuthBody = "407 Proxy Authentication Required\n"
+
+// checkProxyAuth 检查 Basic Proxy-Authorization，用户与 SOCKS5 认证共用 LocalUsers
+func (c *ProxyClient) checkProxyAuth(req *http.Request) bool {
+	if len(c.ClientConfig.LocalUsers) == 0 {
+		return true
+	}
+	user, passwd, ok := parseProxyAuth(req.Header.Get("Proxy-Authorization"))
+	return ok && c.checkLocalUser(user, passwd)
+}
+
+func parseProxyAuth(auth string) (user, passwd string, ok bool) {
+	scheme, encoded, ok := strings.Cut(strings.TrimSpace(auth), " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
+
+// writeProxyAuthRequired 回复 407，close 为 false 时客户端可以在同一个连接上带着凭据重试
+func writeProxyAuthRequired(conn net.Conn, close bool) error {
+	connection := "keep-alive"
+	if close {
+		connection = "close"
+	}
+	_, err := fmt.Fprintf(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n"+
+		"Proxy-Authenticate: Basic realm=\"Draylix\", charset=\"UTF-8\"\r\n"+
+		"Content-Type: text/plain\r\nContent-Length: %d\r\nConnection: %s\r\n\r\n%s",
+		len(proxyAuthBody), connection, proxyAuthBody)
+	return err
+}
@@ -0,0 +1,68 @@
+package client
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestHttpProxyAuth(t *testing.T) {
+	target := newEchoHttpServer(t, "a")
+	local := startLocalProxy(t, map[string]string{"alice": "secret"})
+
+	cases := []struct {
+		user   *url.Userinfo
+		status int
+	}{
+		{url.UserPassword("alice", "secret"), http.StatusOK},
+		{url.UserPassword("alice", "wrong"), http.StatusProxyAuthRequired},
+		{nil, http.StatusProxyAuthRequired},
+	}
+	for _, c := range cases {
+		proxyURL := &url.URL{Scheme: "http", Host: local, User: c.user}
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+		resp, err := client.Get(target.URL + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.status {
+			t.Errorf("%v: got %d, want %d", c.user, resp.StatusCode, c.status)
+		}
+		if c.status == http.StatusProxyAuthRequired && resp.Header.Get("Proxy-Authenticate") == "" {
+			t.Error("missing Proxy-Authenticate header")
+		}
+	}
+}
+
+func TestConnectAuthRetry(t *testing.T) {
+	target := startEcho(t, "tcp4", "127.0.0.1:0").Addr().String()
+	conn, err := net.Dial("tcp", startLocalProxy(t, map[string]string{"alice": "secret"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	_, _ = io.WriteString(conn, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n")
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil || resp.StatusCode != http.StatusProxyAuthRequired || resp.Close {
+		t.Fatalf("got %v %v", resp, err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	auth := base64.StdEncoding.EncodeToString([]byte("alice:secret"))
+	_, _ = io.WriteString(conn, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\nProxy-Authorization: Basic "+auth+"\r\n\r\nping")
+	resp, err = http.ReadResponse(r, &http.Request{Method: http.MethodConnect})
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %v %v", resp, err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(r, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("got %q %v", buf, err)
+	}
+}
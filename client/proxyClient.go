@@ -4,227 +4,335 @@ import (
 	"Draylix2/dlog"
 	"Draylix2/network"
 	"bufio"
-	"bytes"
 	"crypto/tls"
+	"errors"
 	"fmt"
-	"github.com/oschwald/geoip2-golang"
 	"net"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 )
 
+// ServerConfig 是一个可以在规则中用 PROXY:<Name> 指定的服务器节点
 type ServerConfig struct {
-	addr string
+	Name   string
+	Addr   string
+	UserId string
+	Passwd string
 }
 
 type ProxyClientConfig struct {
-	LocalAddr    string
-	ServerAddr   string
-	UserId       string
-	Passwd       string
-	MMDBFile     string
-	PoliciesFile string
+	LocalAddr  string
+	ServerAddr string
+	UserId     string
+	Passwd     string
+	MMDBFile   string
+	// ASNFile 是 GeoLite2-ASN 数据库，asn 规则需要
+	ASNFile string
+	// GeoIPCountryOnly 为 true 时只做 Country 查询，可以使用 Country 数据库
+	GeoIPCountryOnly bool
+	PoliciesFile     string
+	// PolicySources 在 PoliciesFile 之后按顺序加载
+	PolicySources []network.PolicySource
+	// ResolveAll 为 true 时所有 IP 和地理位置规则都会解析域名目标后匹配
+	ResolveAll bool
+	// TunnelDNS 不为空时通过隧道用 TCP 查询这个 DNS 服务器，例如 8.8.8.8:53，否则使用本地 DNS
+	TunnelDNS string
+	// FinalAction 是所有规则来源都没有 match 规则时使用的动作，例如 DIRECT 或 PROXY:tokyo，为空时为 PROXY
+	FinalAction string
+	// RuleProviders 是远程规则，缓存文件在 PolicySources 之后按顺序加载
+	RuleProviders []network.RuleProvider
+	// Hosts 把域名（可以是 *.example.com）固定到 IP，直连和代理都使用固定的 IP
+	Hosts map[string]string
+	// HostsFiles 是 /etc/hosts 格式的文件，优先级低于 Hosts
+	HostsFiles []string
+	// LocalUsers 不为空时本地 SOCKS5（RFC 1929）和 HTTP（Basic Proxy-Authorization）都需要认证，用户名到密码
+	LocalUsers map[string]string
+	// MaxConns 大于 0 时限制同时处理的本地连接数，达到上限后暂停 Accept
+	MaxConns int
+	// MaxConnsPerIP 大于 0 时限制同一个来源 IP 的连接数，超出的连接直接关闭
+	MaxConnsPerIP int
+	// IdleTimeout 大于 0 时关闭两个方向都没有数据超过这个时间的连接
+	IdleTimeout time.Duration
+	// MaxConnLifetime 大于 0 时限制每个连接的最长时间
+	MaxConnLifetime time.Duration
+	// Servers 是额外的命名节点，ServerAddr 是名为 default 的第一个节点
+	Servers []ServerConfig
+	// NodeStrategy 是没有指定节点时选择节点的策略：manual、latency、round-robin、failover（默认）
+	NodeStrategy string
+	// Node 是 manual 策略使用的节点名，为空时使用第一个节点
+	Node string
+	// HealthCheckInterval 是有多个节点时健康检查的间隔，0 为默认的 1 分钟，小于 0 时不检查
+	HealthCheckInterval time.Duration
+	// ReloadInterval 大于 0 时定期检查规则文件和 MMDB 并热加载
+	ReloadInterval time.Duration
+	// StateFile 保存路由模式等运行状态，为空时使用用户配置目录下的 draylix/state.json
+	StateFile string
+	// ControlAddr 不为空时在这个地址提供控制接口，建议只监听本机地址
+	ControlAddr  string
+	ControlToken string
 	TlsConfig    *tls.Config
 }
 
 type ProxyClient struct {
 	ClientConfig  *ProxyClientConfig
 	listener      net.Listener
-	proxySelector network.PolicySelector
+	proxySelector *network.PolicySelector
+	reloadMutex   sync.Mutex
+	stopWatch     func()
+	stopProviders func()
+	stopCheck     func()
+	nodes         *nodePool
+	control       *http.Server
+	modeMutex     sync.Mutex
+	conns         connTracker
+	// OnModeChange 在路由模式切换后调用，例如用于更新界面
+	OnModeChange func(mode string)
+	// OnNodeChange 在默认节点切换后调用，例如用 ClientTUI.SetNode 显示
+	OnNodeChange func(node string)
+	// OnTraffic 在转发数据后调用，up 表示本地到远端，可能被多个连接同时调用
+	OnTraffic func(up bool, n int64)
 }
 
 func NewProxyClient(clientConfig *ProxyClientConfig) *ProxyClient {
 	client := &ProxyClient{
 		ClientConfig:  clientConfig,
-		proxySelector: network.PolicySelector{},
+		proxySelector: &network.PolicySelector{},
+		nodes:         newNodePool(clientConfig),
 	}
-	db, err := geoip2.Open(clientConfig.MMDBFile)
+	clientConfig.RuleProviders = validProviders(clientConfig.RuleProviders)
+	for i := range clientConfig.RuleProviders {
+		if clientConfig.RuleProviders[i].CacheFile == "" {
+			clientConfig.RuleProviders[i].CacheFile = defaultProviderCache(clientConfig.RuleProviders[i].Name)
+		}
+	}
+	client.loadState()
+	// 规则中 PROXY:<节点名> 引用的节点必须存在，否则保留原来的规则
+	client.proxySelector.SetNodes(client.nodes.names())
+	client.proxySelector.SetCountryOnly(clientConfig.GeoIPCountryOnly)
+	client.proxySelector.SetResolveAll(clientConfig.ResolveAll)
+	if clientConfig.TunnelDNS != "" {
+		client.proxySelector.SetResolver(network.NewTunnelResolver(client.dialServer, clientConfig.TunnelDNS))
+	}
+	err := client.LoadMMDB(clientConfig.MMDBFile)
 	if err != nil {
 		dlog.Warn("cannot open mmdb file: %s, %s", clientConfig.MMDBFile, err)
 	}
-	client.proxySelector.MMDB = db
+	if clientConfig.ASNFile != "" {
+		err = client.LoadASNDB(clientConfig.ASNFile)
+		if err != nil {
+			dlog.Warn("cannot open asn mmdb file: %s, %s", clientConfig.ASNFile, err)
+		}
+	}
+
+	hosts, err := client.loadHosts()
+	if err != nil {
+		dlog.Warn("cannot load hosts: %s", err)
+	} else {
+		client.proxySelector.SetHosts(hosts)
+	}
 
-	err = client.proxySelector.LoadFromJson(clientConfig.PoliciesFile)
+	err = client.loadPolicySources()
 	if err != nil {
-		dlog.Warn("cannot open policies file %s, %s", clientConfig.PoliciesFile, err)
+		dlog.Warn("cannot load policies: %s", err)
 	}
 	return client
 }
 
+// LoadPolicies 只加载一个 draylix 规则文件，和启动时一样没有 match 规则时追加 FinalAction
 func (c *ProxyClient) LoadPolicies(file string) error {
-	return c.proxySelector.LoadFromJson(file)
+	sources := []network.PolicySource{{Format: network.DraylixFormat, File: file}}
+	skipped, err := c.proxySelector.LoadSources(sources, c.ClientConfig.FinalAction)
+	for _, e := range skipped {
+		dlog.Warn("skip unsupported rule %s", e)
+	}
+	return err
+}
+
+func (c *ProxyClient) policySources() []network.PolicySource {
+	var sources []network.PolicySource
+	if c.ClientConfig.PoliciesFile != "" {
+		sources = append(sources, network.PolicySource{Format: network.DraylixFormat, File: c.ClientConfig.PoliciesFile})
+	}
+	sources = append(sources, c.ClientConfig.PolicySources...)
+	return append(sources, c.providerSources()...)
+}
+
+func (c *ProxyClient) loadPolicySources() error {
+	skipped, err := c.proxySelector.LoadSources(c.policySources(), c.ClientConfig.FinalAction)
+	for _, e := range skipped {
+		dlog.Warn("skip unsupported rule %s", e)
+	}
+	return err
 }
 
 func (c *ProxyClient) LoadMMDB(file string) error {
-	db, err := geoip2.Open(file)
+	db, err := network.OpenMMDB(file)
 	if err != nil {
 		return err
 	}
-	c.proxySelector.MMDB = db
+	c.proxySelector.SetMMDB(db)
 	return nil
 }
 
-func (c *ProxyClient) Listen() error {
-	listener, err := net.Listen("tcp", c.ClientConfig.LocalAddr)
+func (c *ProxyClient) LoadASNDB(file string) error {
+	db, err := network.OpenASNDB(file)
 	if err != nil {
 		return err
 	}
-	dlog.Info("proxy client is listening at %s", c.ClientConfig.LocalAddr)
-	c.listener = listener
-	go c.accept()
+	c.proxySelector.SetASNDB(db)
 	return nil
 }
 
-func (c *ProxyClient) accept() {
-	for {
-		conn, err := c.listener.Accept()
-		if err != nil {
-			dlog.Error("failed to accept local connection: %v", err)
-		}
-		dlog.Debug("local %s connected", conn.RemoteAddr().String())
-		c.handleLocalConn(conn)
-	}
-
+// RuleStats 返回每条规则的命中次数和最后命中时间
+func (c *ProxyClient) RuleStats() []network.RuleStat {
+	return c.proxySelector.RuleStats()
 }
 
-func (c *ProxyClient) handleLocalConn(conn net.Conn) {
-	proxyInfo, err := getProxyInfo(conn)
+func (c *ProxyClient) Listen() error {
+	listener, err := net.Listen("tcp", c.ClientConfig.LocalAddr)
 	if err != nil {
-		dlog.Error("failed to handle local connection: %v", err)
+		return err
 	}
-	drlxConn, err := network.DialDraylixOverTls(c.ClientConfig.UserId, c.ClientConfig.Passwd, c.ClientConfig.ServerAddr, c.ClientConfig.TlsConfig)
-	if err != nil {
-		dlog.Error("can not connect to server : %s", err)
+	dlog.Info("proxy client is listening at %s", c.ClientConfig.LocalAddr)
+	c.listener = listener
+	c.conns.init(c.ClientConfig.MaxConns, c.ClientConfig.MaxConnsPerIP)
+	if c.ClientConfig.ReloadInterval > 0 {
+		c.stopWatch = c.WatchReload(c.ClientConfig.ReloadInterval)
 	}
-	proxyConn, err := c.proxySelector.Select(drlxConn, conn, proxyInfo)
-
-}
-
-func getProxyInfo(conn net.Conn) (*network.ProxyInfo, error) {
-	buf := make([]byte, 4*1024)
-	n, err := conn.Read(buf)
-	if err != nil {
-		return nil, err
+	if len(c.ClientConfig.RuleProviders) > 0 {
+		c.stopProviders = c.startProviders()
 	}
-	proxyType, err := parseProxyType(buf[:n])
-	if err != nil {
-		return nil, err
+	if interval := c.ClientConfig.HealthCheckInterval; interval >= 0 && len(c.nodes.nodes) > 1 {
+		if interval == 0 {
+			interval = defaultHealthCheckInterval
+		}
+		c.stopCheck = c.startHealthCheck(interval)
 	}
-	if proxyType == network.HttpProxy || proxyType == network.HttpsProxy {
-		return parseHttpProxyInfo(buf[:n])
+	if c.ClientConfig.ControlAddr != "" {
+		c.control, err = c.serveControl()
+		if err != nil {
+			dlog.Warn("cannot start control api: %s", err)
+		}
 	}
-	return parseSocks5ProxyInfo(conn)
+	go c.accept()
+	return nil
 }
 
-func parseSocks5ProxyInfo(conn net.Conn) (*network.ProxyInfo, error) {
-	_, err := conn.Write([]byte{5, 0})
+func (c *ProxyClient) handleLocalConn(conn net.Conn) {
+	defer conn.Close()
+	r, proxyType, err := detectProxyType(conn)
 	if err != nil {
-		return nil, err
+		dlog.Error("failed to handle local connection: %v", err)
+		return
 	}
-	buf := make([]byte, 512)
-	n, err := conn.Read(buf)
-	if err != nil {
-		return nil, err
+	if proxyType == network.HttpProxy {
+		c.serveHttp(conn, r)
+		return
 	}
-	addr, err := parseSocks5Addr(buf[:n])
+	proxyInfo, err := c.getProxyInfo(conn, r, proxyType)
 	if err != nil {
-		return nil, err
+		dlog.Error("failed to handle local connection: %v", err)
+		return
 	}
-	info := &network.ProxyInfo{
-		ProxyType: network.Socks5Proxy,
-		AddrType:  network.Domain,
-		Addr:      addr,
+	_ = conn.SetReadDeadline(time.Time{})
+	if !c.conns.setWaiting(conn, false) {
+		return
 	}
-	if network.IsValidIP(addr) {
-		info.AddrType = network.Ipv4
+	proxyConn, err := c.proxySelector.Select(c.dialServer, conn, proxyInfo)
+	if err == network.ErrPolicyReject || err == network.ErrPolicyDrop {
+		return
 	}
-	return info, nil
+	if err != nil {
+		dlog.Error("failed to connect to %s : %s", proxyInfo.Addr, err)
+		if errors.Is(err, network.ErrEstablished) {
+			// 已经回复了成功，不能再回复失败
+			return
+		}
+		switch proxyInfo.ProxyType {
+		case network.Socks5Proxy:
+			_ = writeSocks5Reply(conn, socks5ReplyCode(err))
+		case network.Socks4Proxy:
+			_ = writeSocks4Reply(conn, socks4Rejected)
+		case network.HttpsProxy:
+			status, reason := httpFailure(err)
+			_ = writeHttpError(conn, status, reason)
+		}
+		return
+	}
+	c.newRelay(proxyInfo.Addr).Run(conn, proxyConn)
 }
 
-func parseProxyType(p []byte) (byte, error) {
-	if p[0] == 5 {
-		return network.Socks5Proxy, nil
-	} else if strings.HasPrefix(string(p), "CONNECT") {
-		return network.HttpsProxy, nil
-	} else if isHttpProxy(p) {
-		return network.HttpProxy, nil
-	} else {
-		return 0, fmt.Errorf("unknown proxy type")
+func (c *ProxyClient) newRelay(addr string) *network.Relay {
+	return &network.Relay{
+		IdleTimeout: c.ClientConfig.IdleTimeout,
+		MaxLifetime: c.ClientConfig.MaxConnLifetime,
+		OnTraffic:   c.OnTraffic,
+		OnClose: func(stats network.RelayStats) {
+			reason := stats.Reason
+			if stats.Err != nil {
+				reason += ": " + stats.Err.Error()
+			}
+			dlog.Debug("%s closed (%s): up %s, down %s in %v", addr, reason,
+				network.BytesFormat(stats.Up), network.BytesFormat(stats.Down), stats.Duration.Round(time.Millisecond))
+		},
 	}
 }
 
-func isHttpProxy(p []byte) bool {
-	var req string
-	if len(p) > 10 {
-		req = string(p[:10])
-	} else {
-		req = string(p)
+func (c *ProxyClient) getProxyInfo(conn net.Conn, r *bufio.Reader, proxyType byte) (*network.ProxyInfo, error) {
+	switch proxyType {
+	case network.HttpsProxy:
+		return c.connectHandshake(conn, r)
+	case network.Socks4Proxy:
+		return c.socks4Handshake(conn, r)
 	}
-	return strings.HasPrefix(req, "GET") || strings.HasPrefix(req, "POST") || strings.HasPrefix(req, "PUT") || strings.HasPrefix(req, "HEAD") || strings.HasPrefix(req, "DELETE") || strings.HasPrefix(req, "OPTIONS") || strings.HasPrefix(req, "TRACE")
+	return c.socks5Handshake(conn, r)
 }
 
-func parseSocks5Addr(data []byte) (string, error) {
-	if len(data) < 5 {
-		return "", fmt.Errorf("socks5 request is too short")
-	}
-	if data[0] != 0x05 {
-		return "", fmt.Errorf("socks version error")
-	}
-	command := data[1]
-	if command != 0x01 {
-		return "", fmt.Errorf("unsurpported socks5 command : %d", command)
-	}
-	addressType := data[3]
-	var targetHost string
-	switch addressType {
-	case 0x01: // IPv4 address
-		if len(data) < 10 {
-			return "", fmt.Errorf("socks5 address is too short")
+// connectHandshake 读取 CONNECT 请求并检查认证，认证失败时允许客户端在同一个连接上重试
+func (c *ProxyClient) connectHandshake(conn net.Conn, r *bufio.Reader) (*network.ProxyInfo, error) {
+	for attempt := 1; ; attempt++ {
+		req, err := http.ReadRequest(r)
+		if err != nil {
+			return nil, err
+		}
+		if req.Method != http.MethodConnect {
+			_ = writeHttpError(conn, http.StatusBadRequest, "expected CONNECT request")
+			return nil, fmt.Errorf("unexpected %s request on connect tunnel", req.Method)
 		}
-		targetHost = fmt.Sprintf("%d.%d.%d.%d", data[4], data[5], data[6], data[7])
-	case 0x03: // Domain name
-		domainLength := int(data[4])
-		if len(data) < 5+domainLength+2 {
-			return "", fmt.Errorf("socks5 domain is too short")
+		if c.checkProxyAuth(req) {
+			return parseConnectInfo(req, r), nil
+		}
+		last := attempt >= maxConnectAuthAttempts
+		if err := writeProxyAuthRequired(conn, last); err != nil || last {
+			return nil, fmt.Errorf("proxy authentication failed for %s", conn.RemoteAddr())
 		}
-		targetHost = string(data[5 : 5+domainLength])
-	case 0x04: // IPv6 address (unsupported in this example)
-		return "", fmt.Errorf("ipv6 is unsupported")
-	default:
-		return "", fmt.Errorf("unknown socks5 address type %d", addressType)
 	}
-	return targetHost, nil
 }
 
-func parseHttpProxyInfo(requestBytes []byte) (*network.ProxyInfo, error) {
-	reader := bytes.NewReader(requestBytes)
-	req, err := http.ReadRequest(bufio.NewReader(reader))
-	if err != nil {
-		return nil, err
-	}
-	proxyType := parseHttpProxyType(req)
+// parseConnectInfo 转换 CONNECT 请求，请求之后已经收到的数据作为 InitialData
+func parseConnectInfo(req *http.Request, r *bufio.Reader) *network.ProxyInfo {
 	addr, addrType := parsHttpAddr(req)
 	info := &network.ProxyInfo{
-		ProxyType: proxyType,
+		ProxyType: network.HttpsProxy,
 		AddrType:  addrType,
 		Addr:      addr,
 	}
-	if proxyType == network.HttpProxy {
-		info.InitialData = requestBytes
+	if n := r.Buffered(); n > 0 {
+		data, _ := r.Peek(n)
+		info.InitialData = append([]byte(nil), data...)
 	}
-	return info, nil
+	return info
 }
 
 func parsHttpAddr(req *http.Request) (string, byte) {
-	if network.IsValidIP(req.Host) {
-		return req.Host, network.Ipv4
-	}
-	return req.Host, network.Domain
-}
-
-func parseHttpProxyType(req *http.Request) byte {
-	if req.Method == "CONNECT" {
-		return network.HttpsProxy
+	addr := req.Host
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		// 没有端口时去掉 IPv6 字面量的方括号再补上默认端口
+		host = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+		addr = net.JoinHostPort(host, "80")
 	}
-	return network.HttpProxy
+	return addr, network.AddrTypeOf(host)
 }
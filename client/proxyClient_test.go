@@ -0,0 +1,111 @@
+package client
+
+import (
+	"Draylix2/network"
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"golang.org/x/net/proxy"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadSocks5Request(t *testing.T) {
+	cases := []struct {
+		data []byte
+		want string
+	}{
+		{[]byte{5, 1, 0, 1, 127, 0, 0, 1, 0x1f, 0x90}, "127.0.0.1:8080"},
+		{append(append([]byte{5, 1, 0, 3, 11}, "example.com"...), 0x01, 0xbb), "example.com:443"},
+		{[]byte{5, 1, 0, 4, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 80}, "[2001:db8::1]:80"},
+	}
+	for _, c := range cases {
+		got, err := readSocks5Request(bytes.NewReader(c.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c.want {
+			t.Errorf("got %s, want %s", got, c.want)
+		}
+	}
+	if _, err := readSocks5Request(bytes.NewReader([]byte{5, 1, 0, 4, 0x20, 0x01})); err == nil {
+		t.Error("expected error for truncated ipv6 address")
+	}
+}
+
+func TestParseHttpAddr(t *testing.T) {
+	cases := []struct {
+		request  string
+		addr     string
+		addrType byte
+	}{
+		{"CONNECT [2001:db8::1]:443 HTTP/1.1\r\nHost: [2001:db8::1]:443\r\n\r\n", "[2001:db8::1]:443", network.Ipv6},
+		{"GET http://[2001:db8::1]/ HTTP/1.1\r\nHost: [2001:db8::1]\r\n\r\n", "[2001:db8::1]:80", network.Ipv6},
+		{"GET http://10.0.0.1/ HTTP/1.1\r\nHost: 10.0.0.1\r\n\r\n", "10.0.0.1:80", network.Ipv4},
+		{"GET http://example.com:8080/ HTTP/1.1\r\nHost: example.com:8080\r\n\r\n", "example.com:8080", network.Domain},
+	}
+	for _, c := range cases {
+		req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(c.request)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr, addrType := parsHttpAddr(req)
+		if addr != c.addr || addrType != c.addrType {
+			t.Errorf("got %s %d, want %s %d", addr, addrType, c.addr, c.addrType)
+		}
+	}
+}
+
+func TestProxiedConnect(t *testing.T) {
+	c := NewProxyClient(&ProxyClientConfig{
+		ServerAddr: startDraylixServer(t), UserId: "u", Passwd: "secret",
+		StateFile: filepath.Join(t.TempDir(), "state.json"),
+		TlsConfig: &tls.Config{InsecureSkipVerify: true},
+	})
+	if err := c.proxySelector.SetMode(network.ModeGlobal); err != nil {
+		t.Fatal(err)
+	}
+	local := serveLocal(t, c)
+	dialer, _ := proxy.SOCKS5("tcp", local, nil, proxy.Direct)
+	if err := echoThrough(t, dialer, startEcho(t, "tcp4", "127.0.0.1:0").Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := closed.Addr().(*net.TCPAddr)
+	closed.Close()
+
+	// 服务器连接目标失败时不能先回复成功，回复码来自服务器报告的结果
+	conn, err := net.Dial("tcp", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = conn.Write([]byte{5, 1, 0, 5, 1, 0, 1, 127, 0, 0, 1, byte(target.Port >> 8), byte(target.Port)})
+	reply, _ := io.ReadAll(conn)
+	conn.Close()
+	if !bytes.HasPrefix(reply, []byte{5, 0, 5, socks5ConnRefused}) {
+		t.Errorf("socks5: got %v", reply)
+	}
+
+	conn, err = net.Dial("tcp", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _ = io.WriteString(conn, "CONNECT "+target.String()+" HTTP/1.1\r\nHost: "+target.String()+"\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusBadGateway || !strings.Contains(string(body), "connection refused by target") {
+		t.Errorf("http: got %d %q", resp.StatusCode, body)
+	}
+}
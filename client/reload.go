@@ -0,0 +1,134 @@
+package client
+
+import (
+	"Draylix2/dlog"
+	"Draylix2/network"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Reload 重新读取规则来源、hosts 和 MMDB。规则文件无效时返回错误并保留原来的配置，
+// MMDB 和 hosts 与启动时一样只警告，保留当前使用的数据
+func (c *ProxyClient) Reload() error {
+	c.reloadMutex.Lock()
+	defer c.reloadMutex.Unlock()
+
+	policies, skipped, err := network.LoadPolicySources(c.policySources(), c.ClientConfig.FinalAction)
+	if err != nil {
+		return err
+	}
+	for _, e := range skipped {
+		dlog.Warn("skip unsupported rule %s", e)
+	}
+
+	mmdbFile := c.ClientConfig.MMDBFile
+	db := c.proxySelector.MMDB()
+	if mmdbFile != "" {
+		if opened, err := network.OpenMMDB(mmdbFile); err != nil {
+			dlog.Warn("cannot open mmdb file: %s, %s", mmdbFile, err)
+		} else {
+			db = opened
+		}
+	}
+
+	asnFile := c.ClientConfig.ASNFile
+	asnDB := c.proxySelector.ASNDB()
+	if asnFile != "" {
+		if opened, err := network.OpenASNDB(asnFile); err != nil {
+			dlog.Warn("cannot open asn mmdb file: %s, %s", asnFile, err)
+		} else {
+			asnDB = opened
+		}
+	}
+
+	hosts, hostsErr := c.loadHosts()
+	if hostsErr != nil {
+		dlog.Warn("cannot load hosts: %s", hostsErr)
+	}
+
+	err = c.proxySelector.SetPolicies(policies)
+	if err != nil {
+		return err
+	}
+	if hostsErr == nil {
+		c.proxySelector.SetHosts(hosts)
+	}
+	c.proxySelector.SetMMDB(db)
+	c.proxySelector.SetASNDB(asnDB)
+	dlog.Info("reloaded %d policies", len(policies))
+	return nil
+}
+
+// WatchReload 定期检查规则文件和 MMDB 的修改时间，文件变化或收到 SIGHUP 时重新加载。
+// 返回的函数用于停止监视。
+func (c *ProxyClient) WatchReload(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	stamps := c.watchedStamps()
+
+	go func() {
+		defer signal.Stop(hup)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-hup:
+				dlog.Info("received SIGHUP, reloading policies")
+			case <-ticker.C:
+				current := c.watchedStamps()
+				if equalStamps(stamps, current) {
+					continue
+				}
+				stamps = current
+				dlog.Info("policy files changed, reloading")
+			}
+			if err := c.Reload(); err != nil {
+				dlog.Error("reload failed, keep old policies: %s", err)
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func (c *ProxyClient) watchedStamps() map[string]fileStamp {
+	files := []string{c.ClientConfig.MMDBFile, c.ClientConfig.ASNFile}
+	files = append(files, c.ClientConfig.HostsFiles...)
+	for _, source := range c.policySources() {
+		files = append(files, source.File)
+	}
+	stamps := make(map[string]fileStamp, len(files))
+	for _, file := range files {
+		if file == "" {
+			continue
+		}
+		stat, err := os.Stat(file)
+		if err != nil {
+			stamps[file] = fileStamp{}
+			continue
+		}
+		stamps[file] = fileStamp{modTime: stat.ModTime(), size: stat.Size()}
+	}
+	return stamps
+}
+
+func equalStamps(a, b map[string]fileStamp) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for file, stamp := range a {
+		if other, ok := b[file]; !ok || !stamp.modTime.Equal(other.modTime) || stamp.size != other.size {
+			return false
+		}
+	}
+	return true
+}
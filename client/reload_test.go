@@ -0,0 +1,111 @@
+package client
+
+import (
+	"Draylix2/network"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReloadKeepsOldPoliciesOnError(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "policies.json")
+	writeFile(t, file, `[{"Type":"domain","Value":"a.com","IsProxy":0},{"Type":"match","IsProxy":1}]`)
+	c := NewProxyClient(&ProxyClientConfig{PoliciesFile: file, StateFile: filepath.Join(filepath.Dir(file), "state.json")})
+	if n := len(c.proxySelector.Policies()); n != 2 {
+		t.Fatalf("got %d policies", n)
+	}
+
+	writeFile(t, file, `[{"Type":"domain","Value":"a.com","IsProxy":0},{"Type":"ip","Value":"10.0.0.0/8","IsProxy":0},{"Type":"match","IsProxy":1}]`)
+	if err := c.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(c.proxySelector.Policies()); n != 3 {
+		t.Fatalf("got %d policies after reload", n)
+	}
+
+	writeFile(t, file, `[{"Type":"ip","Value":"not a cidr","IsProxy":0},{"Type":"match","IsProxy":1}]`)
+	if err := c.Reload(); err == nil {
+		t.Fatal("expected reload error")
+	}
+	if n := len(c.proxySelector.Policies()); n != 3 {
+		t.Fatalf("bad file replaced policies, got %d", n)
+	}
+}
+
+func TestLoadPolicies(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "policies.json")
+	c := NewProxyClient(&ProxyClientConfig{
+		Servers:     []ServerConfig{{Name: "tokyo"}},
+		FinalAction: network.ActionDirect,
+		StateFile:   filepath.Join(dir, "state.json"),
+	})
+
+	// 和启动时一样，没有 match 规则时追加 FinalAction
+	writeFile(t, file, `[{"Type":"domain","Value":"a.com","Action":"PROXY:tokyo"}]`)
+	if err := c.LoadPolicies(file); err != nil {
+		t.Fatal(err)
+	}
+	policies := c.proxySelector.Policies()
+	if action, _ := policies[len(policies)-1].Act(); len(policies) != 2 || action != network.ActionDirect {
+		t.Fatalf("got %d policies, final %s", len(policies), action)
+	}
+
+	writeFile(t, file, `[{"Type":"domain","Value":"a.com","Action":"PROXY:tokio"}]`)
+	if err := c.LoadPolicies(file); err == nil || !strings.Contains(err.Error(), "unknown node") {
+		t.Fatalf("got %v", err)
+	}
+	if _, node := c.proxySelector.Policies()[0].Act(); node != "tokyo" {
+		t.Errorf("unknown node replaced the old policies, node %s", node)
+	}
+}
+
+func TestReloadMissingMMDB(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "policies.json")
+	writeFile(t, file, `[{"Type":"match","IsProxy":1}]`)
+	c := NewProxyClient(&ProxyClientConfig{
+		PoliciesFile: file,
+		MMDBFile:     filepath.Join(filepath.Dir(file), "missing.mmdb"),
+		ASNFile:      filepath.Join(filepath.Dir(file), "missing-asn.mmdb"),
+		HostsFiles:   []string{filepath.Join(filepath.Dir(file), "missing-hosts")},
+		StateFile:    filepath.Join(filepath.Dir(file), "state.json"),
+	})
+
+	// 和启动时一样，MMDB 和 hosts 打不开只警告，规则照常更新
+	writeFile(t, file, `[{"Type":"domain","Value":"a.com","IsProxy":0},{"Type":"match","IsProxy":1}]`)
+	if err := c.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(c.proxySelector.Policies()); n != 2 {
+		t.Fatalf("got %d policies after reload", n)
+	}
+}
+
+func TestWatchReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "policies.json")
+	writeFile(t, file, `[]`)
+	c := NewProxyClient(&ProxyClientConfig{PoliciesFile: file, StateFile: filepath.Join(filepath.Dir(file), "state.json")})
+	stop := c.WatchReload(20 * time.Millisecond)
+	defer stop()
+
+	writeFile(t, file, `[{"Type":"match","IsProxy":1}]`)
+	deadline := time.Now().Add(2 * time.Second)
+	for len(c.proxySelector.Policies()) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("policies were not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if c.proxySelector.Policies()[0].Type != network.MatchPolicy {
+		t.Fatalf("unexpected policy %+v", c.proxySelector.Policies()[0])
+	}
+}
+
+func writeFile(t *testing.T, file, content string) {
+	t.Helper()
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
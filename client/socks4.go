@@ -0,0 +1,93 @@
+package client
+
+import (
+	"Draylix2/dlog"
+	"Draylix2/network"
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+const (
+	socks4Version    = 0x04
+	socks4CmdConnect = 0x01
+
+	socks4Granted        = 0x5A
+	socks4Rejected       = 0x5B
+	socks4UserIdMismatch = 0x5D
+
+	// userid 和 4a 域名都以 0 结尾，限制长度避免无限读取
+	socks4MaxField = 255
+)
+
+// socks4Handshake 读取 SOCKS4/4a 请求。SOCKS4 没有密码，设置了 LocalUsers 时拒绝 SOCKS4 连接
+func (c *ProxyClient) socks4Handshake(conn net.Conn, r *bufio.Reader) (*network.ProxyInfo, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	userId, err := readSocks4String(r)
+	if err != nil {
+		return nil, err
+	}
+	if header[1] != socks4CmdConnect {
+		_ = writeSocks4Reply(conn, socks4Rejected)
+		return nil, fmt.Errorf("unsupported socks4 command : %d", header[1])
+	}
+	if len(c.ClientConfig.LocalUsers) > 0 {
+		_ = writeSocks4Reply(conn, socks4UserIdMismatch)
+		return nil, fmt.Errorf("socks4 has no password, rejected user %q", userId)
+	}
+
+	port := binary.BigEndian.Uint16(header[2:4])
+	ip := net.IP(header[4:8])
+	host := ip.String()
+	// SOCKS4a：IP 为 0.0.0.x（x 不为 0）时 userid 之后是域名
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		host, err = readSocks4String(r)
+		if err != nil {
+			return nil, err
+		}
+		if host == "" {
+			_ = writeSocks4Reply(conn, socks4Rejected)
+			return nil, fmt.Errorf("empty socks4a domain")
+		}
+	}
+	dlog.Debug("socks4 user %q connect %s", userId, host)
+
+	info := &network.ProxyInfo{
+		ProxyType: network.Socks4Proxy,
+		AddrType:  network.AddrTypeOf(host),
+		Addr:      net.JoinHostPort(host, strconv.Itoa(int(port))),
+	}
+	if n := r.Buffered(); n > 0 {
+		data, _ := r.Peek(n)
+		info.InitialData = append([]byte(nil), data...)
+	}
+	return info, nil
+}
+
+func readSocks4String(r *bufio.Reader) (string, error) {
+	var s []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if b == 0 {
+			return string(s), nil
+		}
+		if len(s) >= socks4MaxField {
+			return "", fmt.Errorf("socks4 field is too long")
+		}
+		s = append(s, b)
+	}
+}
+
+func writeSocks4Reply(conn net.Conn, code byte) error {
+	_, err := conn.Write([]byte{0x00, code, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,67 @@
+package client
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func socks4Request(cmd byte, port int, ip net.IP, userId, domain string) []byte {
+	req := []byte{socks4Version, cmd, byte(port >> 8), byte(port)}
+	req = append(req, ip.To4()...)
+	req = append(append(req, userId...), 0)
+	if domain != "" {
+		req = append(append(req, domain...), 0)
+	}
+	return req
+}
+
+func TestSocks4(t *testing.T) {
+	target := startEcho(t, "tcp4", "127.0.0.1:0").Addr().(*net.TCPAddr)
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := closed.Addr().(*net.TCPAddr).Port
+	closed.Close()
+
+	open := startLocalProxy(t, nil)
+	authed := startLocalProxy(t, map[string]string{"alice": "secret"})
+	cases := []struct {
+		name    string
+		local   string
+		request []byte
+		code    byte
+	}{
+		{"socks4", open, socks4Request(socks4CmdConnect, target.Port, target.IP, "alice", ""), socks4Granted},
+		{"socks4a", open, socks4Request(socks4CmdConnect, target.Port, net.IPv4(0, 0, 0, 1), "", "localhost"), socks4Granted},
+		{"bind", open, socks4Request(2, target.Port, target.IP, "", ""), socks4Rejected},
+		{"refused", open, socks4Request(socks4CmdConnect, closedPort, target.IP, "", ""), socks4Rejected},
+		{"auth required", authed, socks4Request(socks4CmdConnect, target.Port, target.IP, "alice", ""), socks4UserIdMismatch},
+	}
+	for _, c := range cases {
+		conn, err := net.Dial("tcp", c.local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Write(append(c.request, "ping"...)); err != nil {
+			t.Fatal(err)
+		}
+		reply := make([]byte, 8)
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if reply[0] != 0 || reply[1] != c.code {
+			t.Errorf("%s: got reply %v, want code %#x", c.name, reply, c.code)
+		}
+		if c.code == socks4Granted {
+			// 请求后紧跟的数据也要转发
+			echo := make([]byte, 4)
+			if _, err := io.ReadFull(conn, echo); err != nil || !bytes.Equal(echo, []byte("ping")) {
+				t.Errorf("%s: got %q %v", c.name, echo, err)
+			}
+		}
+		conn.Close()
+	}
+}
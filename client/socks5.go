@@ -0,0 +1,217 @@
+package client
+
+import (
+	"Draylix2/network"
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// SOCKS5 协议常量（RFC 1928、RFC 1929）
+const (
+	socks5Version     = 0x05
+	socks5AuthVersion = 0x01
+
+	socks5MethodNoAuth       = 0x00
+	socks5MethodUserPass     = 0x02
+	socks5MethodNoAcceptable = 0xff
+
+	socks5CmdConnect = 0x01
+
+	socks5AtypIpv4   = 0x01
+	socks5AtypDomain = 0x03
+	socks5AtypIpv6   = 0x04
+
+	socks5GeneralFailure     = 0x01
+	socks5NetworkUnreachable = 0x03
+	socks5HostUnreachable    = 0x04
+	socks5ConnRefused        = 0x05
+	socks5TTLExpired         = 0x06
+	socks5CmdNotSupported    = 0x07
+	socks5AtypNotSupported   = 0x08
+)
+
+// socks5Error 是需要用回复码告诉客户端的请求错误
+type socks5Error struct {
+	code byte
+	err  error
+}
+
+func (e *socks5Error) Error() string {
+	return e.err.Error()
+}
+
+// socks5Handshake 完成方法协商、认证并读取请求，成功回复在连接建立后由 PolicySelector 发送
+func (c *ProxyClient) socks5Handshake(conn net.Conn, r *bufio.Reader) (*network.ProxyInfo, error) {
+	if err := c.socks5Negotiate(conn, r); err != nil {
+		return nil, err
+	}
+	addr, err := readSocks5Request(r)
+	if err != nil {
+		var se *socks5Error
+		if errors.As(err, &se) {
+			_ = writeSocks5Reply(conn, se.code)
+		}
+		return nil, err
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	info := &network.ProxyInfo{
+		ProxyType: network.Socks5Proxy,
+		AddrType:  network.AddrTypeOf(host),
+		Addr:      addr,
+	}
+	// 客户端没有等回复就发送的数据
+	if n := r.Buffered(); n > 0 {
+		data, _ := r.Peek(n)
+		info.InitialData = append([]byte(nil), data...)
+	}
+	return info, nil
+}
+
+func (c *ProxyClient) socks5Negotiate(conn net.Conn, r io.Reader) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	if header[0] != socks5Version {
+		return fmt.Errorf("socks version error")
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return err
+	}
+
+	method := byte(socks5MethodNoAuth)
+	if len(c.ClientConfig.LocalUsers) > 0 {
+		method = socks5MethodUserPass
+	}
+	if !bytes.Contains(methods, []byte{method}) {
+		_, _ = conn.Write([]byte{socks5Version, socks5MethodNoAcceptable})
+		return fmt.Errorf("no acceptable socks5 auth method in %v", methods)
+	}
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return err
+	}
+	if method == socks5MethodUserPass {
+		return c.socks5Auth(conn, r)
+	}
+	return nil
+}
+
+// socks5Auth 是 RFC 1929 用户名密码认证
+func (c *ProxyClient) socks5Auth(conn net.Conn, r io.Reader) error {
+	version := make([]byte, 1)
+	if _, err := io.ReadFull(r, version); err != nil {
+		return err
+	}
+	if version[0] != socks5AuthVersion {
+		return fmt.Errorf("socks5 auth version error")
+	}
+	user, err := readSocks5String(r)
+	if err != nil {
+		return err
+	}
+	passwd, err := readSocks5String(r)
+	if err != nil {
+		return err
+	}
+	if !c.checkLocalUser(user, passwd) {
+		_, _ = conn.Write([]byte{socks5AuthVersion, 0x01})
+		return fmt.Errorf("socks5 auth failed for user %q", user)
+	}
+	_, err = conn.Write([]byte{socks5AuthVersion, 0x00})
+	return err
+}
+
+func (c *ProxyClient) checkLocalUser(user, passwd string) bool {
+	want, ok := c.ClientConfig.LocalUsers[user]
+	return ok && subtle.ConstantTimeCompare([]byte(want), []byte(passwd)) == 1
+}
+
+func readSocks5String(r io.Reader) (string, error) {
+	length := make([]byte, 1)
+	if _, err := io.ReadFull(r, length); err != nil {
+		return "", err
+	}
+	s := make([]byte, length[0])
+	if _, err := io.ReadFull(r, s); err != nil {
+		return "", err
+	}
+	return string(s), nil
+}
+
+// readSocks5Request 读取 CONNECT 请求，返回 host:port
+func readSocks5Request(r io.Reader) (string, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", err
+	}
+	if header[0] != socks5Version {
+		return "", &socks5Error{socks5GeneralFailure, fmt.Errorf("socks version error")}
+	}
+	if header[1] != socks5CmdConnect {
+		return "", &socks5Error{socks5CmdNotSupported, fmt.Errorf("unsupported socks5 command : %d", header[1])}
+	}
+
+	var host string
+	switch header[3] {
+	case socks5AtypIpv4, socks5AtypIpv6:
+		ip := make(net.IP, net.IPv4len)
+		if header[3] == socks5AtypIpv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socks5AtypDomain:
+		domain, err := readSocks5String(r)
+		if err != nil {
+			return "", err
+		}
+		if domain == "" {
+			return "", &socks5Error{socks5GeneralFailure, fmt.Errorf("empty socks5 domain")}
+		}
+		host = domain
+	default:
+		return "", &socks5Error{socks5AtypNotSupported, fmt.Errorf("unknown socks5 address type %d", header[3])}
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+func writeSocks5Reply(conn net.Conn, code byte) error {
+	_, err := conn.Write([]byte{socks5Version, code, 0x00, socks5AtypIpv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// socks5ReplyCode 把连接目标时的错误转换为 SOCKS5 回复码
+func socks5ReplyCode(err error) byte {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, network.ErrServerUnavailable):
+		// 代理服务器的错误不代表目标的状态
+		return socks5GeneralFailure
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socks5ConnRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socks5NetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr):
+		return socks5HostUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return socks5TTLExpired
+	}
+	return socks5GeneralFailure
+}
@@ -0,0 +1,221 @@
+package client
+
+import (
+	"Draylix2/network"
+	"bytes"
+	"golang.org/x/net/proxy"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startEcho 启动一个回显服务器
+func startEcho(t *testing.T, network, addr string) net.Listener {
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		t.Skip(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener
+}
+
+// startLocalProxy 启动一个直连模式的本地代理，返回监听地址
+func startLocalProxy(t *testing.T, users map[string]string) string {
+	c := NewProxyClient(&ProxyClientConfig{
+		StateFile:  filepath.Join(t.TempDir(), "state.json"),
+		LocalUsers: users,
+	})
+	if err := c.proxySelector.SetMode(network.ModeDirect); err != nil {
+		t.Fatal(err)
+	}
+	return serveLocal(t, c)
+}
+
+// serveLocal 在随机端口上接受本地连接，返回监听地址
+func serveLocal(t *testing.T, c *ProxyClient) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go c.handleLocalConn(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func echoThrough(t *testing.T, dialer proxy.Dialer, target string) error {
+	conn, err := dialer.Dial("tcp", target)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("%s: got %q", target, buf)
+	}
+	return nil
+}
+
+func TestSocks5Connect(t *testing.T) {
+	local := startLocalProxy(t, nil)
+	dialer, err := proxy.SOCKS5("tcp", local, nil, proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo4 := startEcho(t, "tcp4", "127.0.0.1:0")
+	_, port, _ := net.SplitHostPort(echo4.Addr().String())
+	targets := []string{echo4.Addr().String(), net.JoinHostPort("localhost", port)}
+	if echo6, err := net.Listen("tcp6", "[::1]:0"); err == nil {
+		echo6.Close()
+		targets = append(targets, startEcho(t, "tcp6", "[::1]:0").Addr().String())
+	}
+	for _, target := range targets {
+		if err := echoThrough(t, dialer, target); err != nil {
+			t.Errorf("%s: %v", target, err)
+		}
+	}
+}
+
+func TestSocks5Auth(t *testing.T) {
+	local := startLocalProxy(t, map[string]string{"alice": "secret"})
+	target := startEcho(t, "tcp4", "127.0.0.1:0").Addr().String()
+
+	cases := []struct {
+		auth *proxy.Auth
+		ok   bool
+	}{
+		{&proxy.Auth{User: "alice", Password: "secret"}, true},
+		{&proxy.Auth{User: "alice", Password: "wrong"}, false},
+		{&proxy.Auth{User: "bob", Password: "secret"}, false},
+		{nil, false},
+	}
+	for _, c := range cases {
+		dialer, err := proxy.SOCKS5("tcp", local, c.auth, proxy.Direct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := echoThrough(t, dialer, target); (err == nil) != c.ok {
+			t.Errorf("auth %+v: got %v", c.auth, err)
+		}
+	}
+}
+
+func TestSocks5ConnectionRefused(t *testing.T) {
+	local := startLocalProxy(t, nil)
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := closed.Addr().String()
+	closed.Close()
+
+	dialer, _ := proxy.SOCKS5("tcp", local, nil, proxy.Direct)
+	err = echoThrough(t, dialer, target)
+	if err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestSocks5Replies(t *testing.T) {
+	local := startLocalProxy(t, nil)
+	cases := []struct {
+		name    string
+		request []byte
+		reply   []byte
+	}{
+		{"bind", []byte{5, 1, 0, 5, 2, 0, 1, 127, 0, 0, 1, 0, 80}, []byte{5, 0, 5, socks5CmdNotSupported}},
+		{"address type", []byte{5, 1, 0, 5, 1, 0, 9}, []byte{5, 0, 5, socks5AtypNotSupported}},
+		{"no method", []byte{5, 1, 2}, []byte{5, socks5MethodNoAcceptable}},
+	}
+	for _, c := range cases {
+		conn, err := net.Dial("tcp", local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Write(c.request); err != nil {
+			t.Fatal(err)
+		}
+		reply, _ := io.ReadAll(conn)
+		conn.Close()
+		if !bytes.HasPrefix(reply, c.reply) {
+			t.Errorf("%s: got %v, want prefix %v", c.name, reply, c.reply)
+		}
+	}
+}
+
+func TestSocks5Fragmented(t *testing.T) {
+	local := startLocalProxy(t, nil)
+	target := startEcho(t, "tcp4", "127.0.0.1:0").Addr().(*net.TCPAddr)
+	conn, err := net.Dial("tcp", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// 问候和请求逐字节发送
+	request := []byte{5, 1, 0, 5, 1, 0, 1, 127, 0, 0, 1, byte(target.Port >> 8), byte(target.Port)}
+	for _, b := range request {
+		if _, err := conn.Write([]byte{b}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	reply := make([]byte, 12)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reply[:4], []byte{5, 0, 5, 0}) {
+		t.Fatalf("got %v", reply)
+	}
+}
+
+func TestSocks5NotAllowed(t *testing.T) {
+	c := NewProxyClient(&ProxyClientConfig{StateFile: filepath.Join(t.TempDir(), "state.json")})
+	if err := c.proxySelector.SetPolicies([]*network.Policy{
+		{Type: network.DomainPolicy, Value: ".blocked.test", Action: network.ActionReject},
+		{Type: network.MatchPolicy, IsProxy: network.Direct},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", serveLocal(t, c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	request := append([]byte{5, 1, 0, 5, 1, 0, 3, 16}, "www.blocked.test"...)
+	if _, err := conn.Write(append(request, 0, 80)); err != nil {
+		t.Fatal(err)
+	}
+	reply, _ := io.ReadAll(conn)
+	if !bytes.Equal(reply, []byte{5, 0, 5, 2, 0, 1, 0, 0, 0, 0, 0, 0}) {
+		t.Errorf("got %v", reply)
+	}
+}
@@ -2,14 +2,19 @@ package main
 
 import (
 	"Draylix2/network"
+	"Draylix2/ui"
 	"crypto/tls"
 	"fmt"
 	"log"
 	"net"
+	"os"
 	"time"
 )
 
 func main() {
+	if len(os.Args) > 2 && os.Args[1] == "policy" && os.Args[2] == "test" {
+		os.Exit(policyTest(os.Args[3:]))
+	}
 	//testKey()
 	//testTUI()
 	//network.TestAuth()
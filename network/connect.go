@@ -0,0 +1,109 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// ConnectRep 的状态，数据的第一个字节是状态，后面是失败的说明
+const (
+	ConnectOK = byte(iota)
+	ConnectFailed
+	ConnectRefused
+	ConnectNetUnreachable
+	ConnectHostUnreachable
+	ConnectTimedOut
+)
+
+// connectReplyTimeout 是等待服务器回复连接结果的时间，比服务器连接目标的超时稍长
+const connectReplyTimeout = directDialTimeout + 5*time.Second
+
+// ConnectError 是服务器连接目标失败时回复的错误。Unwrap 返回对应的系统错误，
+// 所以可以和直连时的错误一样转换为 SOCKS5 回复码和 HTTP 状态码
+type ConnectError struct {
+	Addr   string
+	Status byte
+	Reason string
+}
+
+func (e *ConnectError) Error() string {
+	return fmt.Sprintf("server failed to connect to %s: %s", e.Addr, e.Reason)
+}
+
+func (e *ConnectError) Unwrap() error {
+	switch e.Status {
+	case ConnectRefused:
+		return syscall.ECONNREFUSED
+	case ConnectNetUnreachable:
+		return syscall.ENETUNREACH
+	case ConnectHostUnreachable:
+		return syscall.EHOSTUNREACH
+	case ConnectTimedOut:
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+// connectStatus 把服务器连接目标时的错误转换为 ConnectRep 的状态
+func connectStatus(err error) byte {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ConnectRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return ConnectNetUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr):
+		return ConnectHostUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ConnectTimedOut
+	}
+	return ConnectFailed
+}
+
+// requestConnect 请求服务器连接 addr 并等待结果，服务器没有回复时返回 ErrServerUnavailable
+func requestConnect(conn net.Conn, addr string) error {
+	if err := writeMessage(conn, ConnectReq, []byte(addr)); err != nil {
+		return fmt.Errorf("%w: %w", ErrServerUnavailable, err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(connectReplyTimeout))
+	msgType, data, err := readMessage(conn)
+	_ = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrServerUnavailable, err)
+	}
+	if msgType != ConnectRep || len(data) == 0 {
+		return fmt.Errorf("%w: expected message type %v, got %v", ErrServerUnavailable, ConnectRep, msgType)
+	}
+	if data[0] != ConnectOK {
+		return &ConnectError{Addr: addr, Status: data[0], Reason: string(data[1:])}
+	}
+	return nil
+}
+
+// HandleConnect 在服务器端处理一个隧道的连接请求：读取 ConnectReq，连接目标后回复 ConnectRep。
+// 成功时返回目标连接和地址，由调用者在两个连接之间转发数据
+func HandleConnect(conn net.Conn) (net.Conn, string, error) {
+	msgType, data, err := readMessage(conn)
+	if err != nil {
+		return nil, "", err
+	}
+	if msgType != ConnectReq {
+		return nil, "", fmt.Errorf("invalid message type, expected: ConnectReq, got: %d", msgType)
+	}
+	addr := string(data)
+	target, err := net.DialTimeout("tcp", addr, directDialTimeout)
+	if err != nil {
+		_ = writeMessage(conn, ConnectRep, append([]byte{connectStatus(err)}, err.Error()...))
+		return nil, addr, err
+	}
+	if err := writeMessage(conn, ConnectRep, []byte{ConnectOK}); err != nil {
+		_ = target.Close()
+		return nil, addr, err
+	}
+	return target, addr, nil
+}
@@ -0,0 +1,56 @@
+package network
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestConnectStatus(t *testing.T) {
+	cases := []struct {
+		err  error
+		want byte
+	}{
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, ConnectRefused},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ENETUNREACH)}, ConnectNetUnreachable},
+		{&net.DNSError{Err: "no such host", Name: "nope.invalid", IsNotFound: true}, ConnectHostUnreachable},
+		{&net.OpError{Op: "dial", Err: os.ErrDeadlineExceeded}, ConnectTimedOut},
+		{errors.New("boom"), ConnectFailed},
+	}
+	for _, c := range cases {
+		status := connectStatus(c.err)
+		if status != c.want {
+			t.Errorf("%v: got %d, want %d", c.err, status, c.want)
+		}
+		// 客户端还原的错误和直连时的错误有相同的分类
+		if got := connectStatus(&ConnectError{Status: status}); got != c.want {
+			t.Errorf("%v: round trip got %d", c.err, got)
+		}
+	}
+}
+
+func TestHandleConnect(t *testing.T) {
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := closed.Addr().String()
+	closed.Close()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		_, _, _ = HandleConnect(server)
+		server.Close()
+	}()
+	err = requestConnect(client, addr)
+	var connectErr *ConnectError
+	if !errors.As(err, &connectErr) || connectErr.Status != ConnectRefused || !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Fatalf("got %v", err)
+	}
+	if errors.Is(err, ErrServerUnavailable) {
+		t.Error("target error reported as server error")
+	}
+}
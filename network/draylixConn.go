@@ -2,11 +2,17 @@ package network
 
 import (
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"time"
 )
 
+// serverDialTimeout 是建立隧道（TCP、TLS 和认证）的超时
+const serverDialTimeout = 10 * time.Second
+
+var errHalfCloseUnsupported = errors.New("transport does not support half-close")
+
 type DraylixConn struct {
 	UserId    string
 	Passwd    string
@@ -14,19 +20,19 @@ type DraylixConn struct {
 }
 
 func DialDraylixOverTls(userId, passwd, addr string, config *tls.Config) (*DraylixConn, error) {
-	tlsConn, err := tls.Dial("tcp", addr, config)
-	if err != nil {
-		return nil, err
-	}
+	tlsConn, err := tls.DialWithDialer(&net.Dialer{Timeout: serverDialTimeout}, "tcp", addr, config)
 	if err != nil {
 		return nil, err
 	}
 
+	// 认证也要在超时内完成，否则无响应的节点会一直阻塞健康检查
+	_ = tlsConn.SetDeadline(time.Now().Add(serverDialTimeout))
 	err = clientAuth(tlsConn, userId, passwd)
 	if err != nil {
 		_ = tlsConn.Close()
-		return nil, fmt.Errorf("draylix authentication failed: %s", err)
+		return nil, fmt.Errorf("draylix authentication failed: %w", err)
 	}
+	_ = tlsConn.SetDeadline(time.Time{})
 	return &DraylixConn{
 		UserId:    userId,
 		Passwd:    passwd,
@@ -46,6 +52,26 @@ func (d *DraylixConn) Close() error {
 	return d.transport.Close()
 }
 
+// CloseWrite 关闭写方向，TLS 传输发送 close_notify，对端读到 EOF 后仍然可以继续发送数据
+func (d *DraylixConn) CloseWrite() error {
+	if cw, ok := d.transport.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errHalfCloseUnsupported
+}
+
+// CloseRead 关闭读方向，TLS 传输关闭底层 TCP 连接的读方向
+func (d *DraylixConn) CloseRead() error {
+	conn := d.transport
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	if cr, ok := conn.(interface{ CloseRead() error }); ok {
+		return cr.CloseRead()
+	}
+	return errHalfCloseUnsupported
+}
+
 func (d *DraylixConn) LocalAddr() net.Addr {
 	return d.transport.LocalAddr()
 }
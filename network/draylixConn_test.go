@@ -2,7 +2,9 @@ package network
 
 import (
 	"bytes"
+	"crypto/tls"
 	"fmt"
+	"io"
 	"log"
 	"testing"
 )
@@ -20,3 +22,44 @@ func TestDialDraylixOverTls(t *testing.T) {
 	fmt.Printf("%v %v", messageType, string(data))
 
 }
+
+func TestDraylixConnHalfClose(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair("../server-cert.pem", "../server-key.pem")
+	if err != nil {
+		t.Skip(err)
+	}
+	listener, err := ListenDraylixOverTls("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}},
+		&DraylixConfig{GetPasswd: gp, HandleInvalidAccess: hia})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// 读到客户端的 EOF 后仍然可以回复
+		req, _ := io.ReadAll(conn)
+		_, _ = conn.Write(append([]byte("re:"), req...))
+		_ = conn.(*DraylixConn).CloseWrite()
+	}()
+
+	conn, err := DialDraylixOverTls("test", "12345678", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _ = conn.Write([]byte("request"))
+	if err := conn.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := io.ReadAll(conn)
+	if err != nil || string(resp) != "re:request" {
+		t.Fatalf("got %q %v", resp, err)
+	}
+	if err := conn.CloseRead(); err != nil {
+		t.Error(err)
+	}
+}
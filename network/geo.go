@@ -0,0 +1,119 @@
+package network
+
+import (
+	"fmt"
+	"github.com/oschwald/geoip2-golang"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// GeoRecord 是一次 GeoIP 查询中规则会用到的字段
+type GeoRecord struct {
+	CountryCode   string
+	Country       string
+	ContinentCode string
+	City          string
+}
+
+// ASNRecord 是 GeoLite2-ASN 数据库的查询结果，Number 为 0 表示没有记录
+type ASNRecord struct {
+	Number       uint
+	Organization string
+}
+
+// OpenMMDB 将 City 或 Country 数据库完整读入内存，不使用 mmap，
+// 替换后旧数据库上正在进行的查询不受影响
+func OpenMMDB(file string) (*geoip2.Reader, error) {
+	db, err := openMMDB(file)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Country(net.IPv4(1, 1, 1, 1)); err != nil {
+		return nil, fmt.Errorf("invalid mmdb %s: %s", file, err)
+	}
+	return db, nil
+}
+
+// OpenASNDB 读取 GeoLite2-ASN 数据库
+func OpenASNDB(file string) (*geoip2.Reader, error) {
+	db, err := openMMDB(file)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.ASN(net.IPv4(1, 1, 1, 1)); err != nil {
+		return nil, fmt.Errorf("invalid asn mmdb %s: %s", file, err)
+	}
+	return db, nil
+}
+
+func openMMDB(file string) (*geoip2.Reader, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return geoip2.FromBytes(data)
+}
+
+// lookupGeo 查询 IP 的地理位置，countryOnly 时只做 Country 查询，没有城市信息
+func lookupGeo(db *geoip2.Reader, ip net.IP, countryOnly bool) (*GeoRecord, error) {
+	if db == nil {
+		return nil, errMMDBNotLoaded
+	}
+	if countryOnly {
+		record, err := db.Country(ip)
+		if err != nil {
+			return nil, err
+		}
+		return &GeoRecord{
+			CountryCode:   record.Country.IsoCode,
+			Country:       record.Country.Names["en"],
+			ContinentCode: record.Continent.Code,
+		}, nil
+	}
+	record, err := db.City(ip)
+	if err != nil {
+		return nil, err
+	}
+	return &GeoRecord{
+		CountryCode:   record.Country.IsoCode,
+		Country:       record.Country.Names["en"],
+		ContinentCode: record.Continent.Code,
+		City:          record.City.Names["en"],
+	}, nil
+}
+
+func lookupASN(db *geoip2.Reader, ip net.IP) (*ASNRecord, error) {
+	if db == nil {
+		return nil, errASNNotLoaded
+	}
+	record, err := db.ASN(ip)
+	if err != nil {
+		return nil, err
+	}
+	return &ASNRecord{Number: record.AutonomousSystemNumber, Organization: record.AutonomousSystemOrganization}, nil
+}
+
+// matchLocationName 匹配英文国家名或城市名，"US/Portland" 形式的值同时要求国家代码或国家名一致
+func matchLocationName(value string, record *GeoRecord) bool {
+	if country, city, ok := strings.Cut(value, "/"); ok {
+		return (strings.EqualFold(country, record.CountryCode) || strings.EqualFold(country, record.Country)) &&
+			record.City != "" && strings.EqualFold(city, record.City)
+	}
+	return (record.Country != "" && strings.EqualFold(value, record.Country)) ||
+		(record.City != "" && strings.EqualFold(value, record.City))
+}
+
+// parseASN 解析 "13335" 或 "AS13335"
+func parseASN(value string) (uint, error) {
+	value = strings.TrimSpace(value)
+	if len(value) > 2 && strings.EqualFold(value[:2], "AS") {
+		value = value[2:]
+	}
+	n, err := strconv.ParseUint(value, 10, 32)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("invalid asn %q", value)
+	}
+	return uint(n), nil
+}
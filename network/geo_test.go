@@ -0,0 +1,149 @@
+package network
+
+import (
+	"github.com/maxmind/mmdbwriter"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func geoEntry(continent, countryCode, country, city string) mmdbtype.Map {
+	return mmdbtype.Map{
+		"continent": mmdbtype.Map{"code": mmdbtype.String(continent)},
+		"country": mmdbtype.Map{
+			"iso_code": mmdbtype.String(countryCode),
+			"names":    mmdbtype.Map{"en": mmdbtype.String(country)},
+		},
+		"city": mmdbtype.Map{"names": mmdbtype.Map{"en": mmdbtype.String(city)}},
+	}
+}
+
+func asnEntry(number uint32, org string) mmdbtype.Map {
+	return mmdbtype.Map{
+		"autonomous_system_number":       mmdbtype.Uint32(number),
+		"autonomous_system_organization": mmdbtype.String(org),
+	}
+}
+
+// writeTestMMDB 生成一个只包含给定网段的 MMDB 文件
+func writeTestMMDB(t testing.TB, dbType string, entries map[string]mmdbtype.Map) string {
+	tree, err := mmdbwriter.New(mmdbwriter.Options{DatabaseType: dbType, RecordSize: 24})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for cidr, entry := range entries {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tree.Insert(ipNet, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file := filepath.Join(t.TempDir(), dbType+".mmdb")
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := tree.WriteTo(f); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func newGeoTestSelector(t testing.TB, policies []*Policy) *PolicySelector {
+	cityFile := writeTestMMDB(t, "GeoIP2-City", map[string]mmdbtype.Map{
+		"1.0.0.0/24":     geoEntry("OC", "AU", "Australia", "Sydney"),
+		"2.0.0.0/24":     geoEntry("NA", "US", "United States", "Portland"),
+		"3.0.0.0/24":     geoEntry("NA", "US", "United States", "Paris"),
+		"4.0.0.0/24":     geoEntry("EU", "FR", "France", "Paris"),
+		"2001:200::/32":  geoEntry("AS", "JP", "Japan", "Tokyo"),
+		"5.0.0.0/24":     geoEntry("AS", "CN", "China", "Beijing"),
+		"101.0.0.0/16":   geoEntry("AS", "CN", "China", ""),
+		"120.200.0.0/16": geoEntry("AS", "HK", "Hong Kong", "Hong Kong"),
+	})
+	asnFile := writeTestMMDB(t, "GeoLite2-ASN", map[string]mmdbtype.Map{
+		"1.0.0.0/24": asnEntry(13335, "Cloudflare"),
+		"4.0.0.0/24": asnEntry(3215, "Orange"),
+	})
+	ps := newTestSelector(t, policies)
+	db, err := OpenMMDB(cityFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	asnDB, err := OpenASNDB(asnFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps.SetMMDB(db)
+	ps.SetASNDB(asnDB)
+	return ps
+}
+
+func TestGeoPolicies(t *testing.T) {
+	policies := []*Policy{
+		{Type: ASNPolicy, Value: "AS13335", IsProxy: UseProxy},
+		{Type: LocationPolicy, Value: "US/Paris", IsProxy: UseProxy},
+		{Type: LocationPolicy, Value: "paris", IsProxy: Direct},
+		{Type: CountryPolicy, Value: "cn", IsProxy: Direct},
+		{Type: LocationPolicy, Value: "Hong Kong", IsProxy: UseProxy},
+		{Type: ContinentPolicy, Value: "AS", Action: ActionReject},
+		{Type: CountryPolicy, Value: "AU", Action: ActionDrop},
+		{Type: MatchPolicy, IsProxy: UseProxy},
+	}
+	ps := newGeoTestSelector(t, policies)
+
+	cases := []struct {
+		addr string
+		want *Policy
+	}{
+		{"1.0.0.1:443", policies[0]},
+		{"3.0.0.1:443", policies[1]},
+		{"4.0.0.1:443", policies[2]},
+		{"2.0.0.1:443", policies[7]},
+		{"5.0.0.1:443", policies[3]},
+		{"101.0.1.1:443", policies[3]},
+		{"120.200.1.1:443", policies[4]},
+		{"[2001:200::1]:443", policies[5]},
+		{"9.9.9.9:443", policies[7]},
+	}
+	for _, c := range cases {
+		info := &ProxyInfo{AddrType: Ipv4, Addr: c.addr}
+		if got := ps.findPolicy(info); got != c.want {
+			t.Errorf("%s: got %+v, want %+v", c.addr, got, c.want)
+		}
+		if got := linearPolicy(ps, info); got != c.want {
+			t.Errorf("%s: linear got %+v, want %+v", c.addr, got, c.want)
+		}
+	}
+}
+
+func TestCountryOnly(t *testing.T) {
+	policies := []*Policy{
+		{Type: LocationPolicy, Value: "Sydney", IsProxy: Direct},
+		{Type: CountryPolicy, Value: "AU", Action: ActionReject},
+		{Type: MatchPolicy, IsProxy: UseProxy},
+	}
+	ps := newGeoTestSelector(t, policies)
+	info := &ProxyInfo{AddrType: Ipv4, Addr: "1.0.0.1:443"}
+	if got := ps.findPolicy(info); got != policies[0] {
+		t.Fatalf("got %+v", got)
+	}
+	ps.SetCountryOnly(true)
+	if got := ps.findPolicy(info); got != policies[1] {
+		t.Fatalf("country only: got %+v", got)
+	}
+}
+
+func TestOpenMMDBRejectsWrongType(t *testing.T) {
+	asnFile := writeTestMMDB(t, "GeoLite2-ASN", map[string]mmdbtype.Map{"1.0.0.0/24": asnEntry(1, "x")})
+	if _, err := OpenMMDB(asnFile); err == nil {
+		t.Error("expected error opening asn database as city database")
+	}
+	if _, err := parseASN("ASx"); err == nil {
+		t.Error("expected error for invalid asn")
+	}
+}
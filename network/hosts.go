@@ -0,0 +1,142 @@
+package network
+
+import (
+	"Draylix2/dlog"
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+// Hosts 把域名固定到指定的 IP，"*.example.com" 匹配所有子域名，完整域名优先于通配符，
+// 通配符中更长的后缀优先
+type Hosts struct {
+	exact    map[string]net.IP
+	wildcard map[string]net.IP
+}
+
+func NewHosts() *Hosts {
+	return &Hosts{exact: make(map[string]net.IP), wildcard: make(map[string]net.IP)}
+}
+
+// Add 添加一条映射，已有的映射会被覆盖
+func (h *Hosts) Add(name, ip string) error {
+	addr := net.ParseIP(strings.Trim(ip, "[]"))
+	if addr == nil {
+		return fmt.Errorf("invalid ip %q", ip)
+	}
+	if v4 := addr.To4(); v4 != nil {
+		addr = v4
+	}
+	wildcard := strings.HasPrefix(name, "*.")
+	domain := normalizeDomain(strings.TrimPrefix(name, "*."))
+	if domain == "" {
+		return fmt.Errorf("empty host name %q", name)
+	}
+	if wildcard {
+		h.wildcard[domain] = addr
+	} else {
+		h.exact[domain] = addr
+	}
+	return nil
+}
+
+// LoadHostsFile 读取 /etc/hosts 格式的文件，已有的映射优先，无法解析的行被跳过
+func (h *Hosts) LoadHostsFile(file string) ([]*LineError, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return h.parse(f, file)
+}
+
+func (h *Hosts) parse(r io.Reader, file string) ([]*LineError, error) {
+	var skipped []*LineError
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := scanner.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			skipped = append(skipped, &LineError{File: file, Line: line, Text: scanner.Text(), Err: fmt.Errorf("missing host name")})
+			continue
+		}
+		for _, name := range fields[1:] {
+			if _, ok := h.lookupExact(name); ok {
+				continue
+			}
+			if err := h.Add(name, fields[0]); err != nil {
+				skipped = append(skipped, &LineError{File: file, Line: line, Text: scanner.Text(), Err: err})
+				break
+			}
+		}
+	}
+	return skipped, scanner.Err()
+}
+
+func (h *Hosts) lookupExact(name string) (net.IP, bool) {
+	m := h.exact
+	if strings.HasPrefix(name, "*.") {
+		m, name = h.wildcard, name[2:]
+	}
+	ip, ok := m[normalizeDomain(name)]
+	return ip, ok
+}
+
+// Lookup 返回域名固定的 IP
+func (h *Hosts) Lookup(domain string) (net.IP, bool) {
+	if h == nil {
+		return nil, false
+	}
+	domain = normalizeDomain(domain)
+	if ip, ok := h.exact[domain]; ok {
+		return ip, true
+	}
+	for i := strings.IndexByte(domain, '.'); i >= 0; i = strings.IndexByte(domain, '.') {
+		domain = domain[i+1:]
+		if ip, ok := h.wildcard[domain]; ok {
+			return ip, true
+		}
+	}
+	return nil, false
+}
+
+func (h *Hosts) Len() int {
+	if h == nil {
+		return 0
+	}
+	return len(h.exact) + len(h.wildcard)
+}
+
+// SetHosts 替换 hosts 映射，nil 表示不使用
+func (ps *PolicySelector) SetHosts(h *Hosts) {
+	ps.hosts.Store(h)
+}
+
+// rewriteHost 把 hosts 中的域名目标改写为固定的 IP，规则匹配和连接都使用改写后的地址
+func (ps *PolicySelector) rewriteHost(info *ProxyInfo) {
+	if info.AddrType != Domain {
+		return
+	}
+	host, port, err := net.SplitHostPort(info.Addr)
+	if err != nil {
+		return
+	}
+	ip, ok := ps.hosts.Load().Lookup(host)
+	if !ok {
+		return
+	}
+	info.Addr = net.JoinHostPort(ip.String(), port)
+	info.AddrType = AddrTypeOf(ip.String())
+	dlog.Debug("hosts: %s -> %s", host, ip)
+}
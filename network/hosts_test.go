@@ -0,0 +1,115 @@
+package network
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+const hostsFile = `# staging
+10.0.0.5    staging.example.com api.staging.example.com
+10.0.0.6    *.example.com
+::1         v6.example.org   # trailing comment
+10.0.0.7    staging.example.com
+broken
+300.1.1.1   bad.example.com
+`
+
+func TestHosts(t *testing.T) {
+	h := NewHosts()
+	if err := h.Add("pinned.example.com", "192.168.1.1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Add("*.r3---sn-ab5l6nzr.test", "192.168.1.2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Add("my_host.lan", "192.168.1.3"); err != nil {
+		t.Fatal(err)
+	}
+	skipped, err := h.parse(strings.NewReader(hostsFile), "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(skipped) != 2 || skipped[0].Line != 6 || skipped[1].Line != 7 {
+		t.Fatalf("unexpected skipped lines: %v", skipped)
+	}
+	cases := []struct {
+		domain string
+		want   string
+	}{
+		{"staging.example.com", "10.0.0.5"},
+		{"API.Staging.Example.com.", "10.0.0.5"},
+		{"pinned.example.com", "192.168.1.1"},
+		{"www.example.com", "10.0.0.6"},
+		{"a.b.example.com", "10.0.0.6"},
+		{"example.com", ""},
+		{"v6.example.org", "::1"},
+		{"other.org", ""},
+		{"a.R3---sn-ab5l6nzr.test", "192.168.1.2"},
+		{"MY_HOST.lan", "192.168.1.3"},
+	}
+	for _, c := range cases {
+		got := ""
+		if ip, ok := h.Lookup(c.domain); ok {
+			got = ip.String()
+		}
+		if got != c.want {
+			t.Errorf("%s: got %q, want %q", c.domain, got, c.want)
+		}
+	}
+}
+
+func TestHostsRewrite(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			_, _ = conn.Write([]byte("pinned"))
+			_ = conn.Close()
+		}
+	}()
+
+	policies := []*Policy{
+		{Type: IPPolicy, Value: "127.0.0.0/8", IsProxy: Direct},
+		{Type: MatchPolicy, Action: ActionReject},
+	}
+	ps := newTestSelector(t, policies)
+	h := NewHosts()
+	if err := h.Add("*.staging.test", "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	ps.SetHosts(h)
+
+	// Explain 和 Select 看到同样的改写结果
+	e, err := ps.Explain(NewTargetInfo("api.staging.test:443"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Target != "127.0.0.1:443" || e.Original != "api.staging.test:443" || e.Policy != policies[0] {
+		t.Errorf("explain: %+v", e)
+	}
+	if !strings.Contains(e.String(), "hosts:    api.staging.test:443 -> 127.0.0.1:443") {
+		t.Errorf("rewrite missing from output:\n%s", e)
+	}
+
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	info := &ProxyInfo{ProxyType: HttpProxy, AddrType: Domain, Addr: net.JoinHostPort("web.staging.test", port)}
+	local, app := net.Pipe()
+	defer app.Close()
+	remote, err := ps.Select(nil, local, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+	if info.AddrType != Ipv4 || info.Addr != listener.Addr().String() {
+		t.Errorf("target not rewritten: %+v", info)
+	}
+	if data, _ := io.ReadAll(remote); string(data) != "pinned" {
+		t.Errorf("got %q", data)
+	}
+}
@@ -0,0 +1,51 @@
+package network
+
+import "fmt"
+
+// 路由模式：rule 按规则选择，global 全部走代理，direct 全部直连
+const (
+	ModeRule   = "rule"
+	ModeGlobal = "global"
+	ModeDirect = "direct"
+)
+
+var (
+	globalPolicy = &Policy{Type: MatchPolicy, IsProxy: UseProxy, Action: ActionProxy, action: ActionProxy}
+	directPolicy = &Policy{Type: MatchPolicy, IsProxy: Direct, Action: ActionDirect, action: ActionDirect}
+)
+
+// ValidMode 检查路由模式是否有效
+func ValidMode(mode string) error {
+	switch mode {
+	case ModeRule, ModeGlobal, ModeDirect:
+		return nil
+	}
+	return fmt.Errorf("unknown routing mode %q", mode)
+}
+
+// SetMode 切换路由模式，对之后的新连接立即生效
+func (ps *PolicySelector) SetMode(mode string) error {
+	if err := ValidMode(mode); err != nil {
+		return err
+	}
+	ps.mode.Store(&mode)
+	return nil
+}
+
+func (ps *PolicySelector) Mode() string {
+	if mode := ps.mode.Load(); mode != nil {
+		return *mode
+	}
+	return ModeRule
+}
+
+// route 根据路由模式选择规则，只有 rule 模式才查找规则列表
+func (ps *PolicySelector) route(info *ProxyInfo) *Policy {
+	switch ps.Mode() {
+	case ModeGlobal:
+		return globalPolicy
+	case ModeDirect:
+		return directPolicy
+	}
+	return ps.findPolicy(info)
+}
@@ -0,0 +1,34 @@
+package network
+
+import (
+	"testing"
+)
+
+func TestRoutingMode(t *testing.T) {
+	policies := []*Policy{
+		{Type: DomainPolicy, Value: ".example.com", Action: ActionReject},
+		{Type: MatchPolicy, IsProxy: Direct},
+	}
+	ps := newTestSelector(t, policies)
+	info := &ProxyInfo{AddrType: Domain, Addr: "www.example.com:443"}
+	cases := []struct {
+		mode   string
+		action string
+	}{
+		{ModeRule, ActionReject},
+		{ModeGlobal, ActionProxy},
+		{ModeDirect, ActionDirect},
+		{ModeRule, ActionReject},
+	}
+	for _, c := range cases {
+		if err := ps.SetMode(c.mode); err != nil {
+			t.Fatal(err)
+		}
+		if action, _ := ps.route(info).Act(); action != c.action {
+			t.Errorf("%s: got %s, want %s", c.mode, action, c.action)
+		}
+	}
+	if err := ps.SetMode("auto"); err == nil {
+		t.Error("expected error for unknown mode")
+	}
+}
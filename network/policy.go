@@ -2,166 +2,531 @@ package network
 
 import (
 	"Draylix2/dlog"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/expr-lang/expr/vm"
 	"github.com/oschwald/geoip2-golang"
+	"golang.org/x/net/idna"
 	"net"
-	"os"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 const (
-	LocationPolicy = "location"
-	IPPolicy       = "ip"
-	DomainPolicy   = "domain"
+	LocationPolicy      = "location"
+	CountryPolicy       = "country"
+	ContinentPolicy     = "continent"
+	ASNPolicy           = "asn"
+	IPPolicy            = "ip"
+	DomainPolicy        = "domain"
+	DomainSuffixPolicy  = "domain-suffix"
+	DomainKeywordPolicy = "domain-keyword"
+	DomainRegexPolicy   = "domain-regex"
+	MatchPolicy         = "match"
+	ProcessPolicy       = "process"
+	UIDPolicy           = "uid"
+	ScriptPolicy        = "script"
 
 	UseProxy = 1
-	Direct=0
+	Direct   = 0
+
+	ActionProxy  = "PROXY"
+	ActionDirect = "DIRECT"
+	ActionReject = "REJECT"
+	ActionDrop   = "DROP"
+
+	// directDialTimeout 是直连目标的超时，超时后本地应用收到 TTL expired 或 504
+	directDialTimeout = 10 * time.Second
 )
 
 type Policy struct {
 	Type    string
 	Value   string
 	IsProxy int
+	// Action 可以是 PROXY、PROXY:<节点名>、DIRECT、REJECT 或 DROP，为空时由 IsProxy 决定
+	Action string `json:",omitempty"`
+	// Resolve 为 true 时 IP 和地理位置规则也会匹配域名目标解析出的所有地址
+	Resolve bool `json:",omitempty"`
+
+	regex  *regexp.Regexp
+	asn    uint
+	uid    uint32
+	script *vm.Program
+	action string
+	node   string
 }
 
+// ServerDialer 连接指定名称的服务器节点，名称为空时使用默认节点
+type ServerDialer func(node string) (net.Conn, error)
+
+// defaultPolicy 在没有加载任何规则时使用
+var defaultPolicy = &Policy{Type: MatchPolicy, IsProxy: UseProxy, action: ActionProxy}
+
+// PolicySelector 的规则集和 MMDB 都可以在运行中原子替换，正在进行的查询继续使用旧的快照
 type PolicySelector struct {
-	policies []*Policy
-	MMDB     *geoip2.Reader
+	policies    atomic.Pointer[policySet]
+	mmdb        atomic.Pointer[geoip2.Reader]
+	asnDB       atomic.Pointer[geoip2.Reader]
+	countryOnly atomic.Bool
+	resolver    atomic.Pointer[net.Resolver]
+	resolveAll  atomic.Bool
+	dnsCache    resolveCache
+	decisions   decisionCache
+	mode        atomic.Pointer[string]
+	processes   processCache
+	hosts       atomic.Pointer[Hosts]
+	nodes       atomic.Pointer[map[string]bool]
+}
+
+// PolicyError 表示规则列表中某一条规则无效
+type PolicyError struct {
+	Index  int
+	Policy *Policy
+	Err    error
+}
+
+func (e *PolicyError) Error() string {
+	return fmt.Sprintf("policy %d (%s %s): %s", e.Index, e.Policy.Type, e.Policy.Value, e.Err)
+}
+
+func (e *PolicyError) Unwrap() error {
+	return e.Err
 }
 
+var (
+	ErrPolicyReject = errors.New("rejected by policy")
+	ErrPolicyDrop   = errors.New("dropped by policy")
+	// ErrServerUnavailable 表示连接或请求代理服务器失败，和目标本身的错误区分
+	ErrServerUnavailable = errors.New("proxy server unavailable")
+	// ErrEstablished 表示已经回复本地应用连接成功之后出错，调用者不能再回复失败
+	ErrEstablished = errors.New("connection already established")
+
+	errMMDBNotLoaded = errors.New("mmdb is not loaded")
+	errASNNotLoaded  = errors.New("asn mmdb is not loaded")
+	errNoResolver    = errors.New("no resolver")
+)
+
+// LoadFromJson 加载一个 draylix 规则文件，没有 match 规则时追加走代理的 match
 func (ps *PolicySelector) LoadFromJson(file string) error {
-	// 打开 JSON 文件
-	f, err := os.Open(file)
+	_, err := ps.LoadSources([]PolicySource{{Format: DraylixFormat, File: file}}, "")
+	return err
+}
+
+// SetPolicies 编译规则并替换当前规则集，规则无效时保留原规则
+func (ps *PolicySelector) SetPolicies(policies []*Policy) error {
+	set, err := compilePolicies(policies)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
+	if err := ps.checkNodes(set.policies); err != nil {
+		return err
+	}
+	set.inheritStats(ps.policies.Swap(set))
+	ps.decisions.clear()
+	return nil
+}
+
+// SetNodes 设置 PROXY:<节点名> 可以使用的节点，之后加载的规则引用其他节点时无效。
+// 没有调用时不检查节点名
+func (ps *PolicySelector) SetNodes(names []string) {
+	nodes := make(map[string]bool, len(names))
+	for _, name := range names {
+		nodes[name] = true
+	}
+	ps.nodes.Store(&nodes)
+}
+
+func (ps *PolicySelector) checkNodes(policies []*Policy) error {
+	nodes := ps.nodes.Load()
+	if nodes == nil {
+		return nil
+	}
+	for i, p := range policies {
+		if _, node := p.Act(); node != "" && !(*nodes)[node] {
+			return &PolicyError{Index: i, Policy: p, Err: fmt.Errorf("unknown node %q", node)}
+		}
+	}
+	return nil
+}
 
-	// 解析 JSON 数据
-	decoder := json.NewDecoder(f)
-	var policies []*Policy
-	if err := decoder.Decode(&policies); err != nil {
+// Policies 返回当前生效的规则列表
+func (ps *PolicySelector) Policies() []*Policy {
+	set := ps.policies.Load()
+	if set == nil {
+		return nil
+	}
+	return set.policies
+}
+
+// SetMMDB 替换 GeoIP 数据库，旧的数据库不会被关闭，由 GC 回收
+func (ps *PolicySelector) SetMMDB(db *geoip2.Reader) {
+	ps.mmdb.Store(db)
+	ps.decisions.clear()
+}
+
+func (ps *PolicySelector) MMDB() *geoip2.Reader {
+	return ps.mmdb.Load()
+}
+
+// SetASNDB 替换 GeoLite2-ASN 数据库
+func (ps *PolicySelector) SetASNDB(db *geoip2.Reader) {
+	ps.asnDB.Store(db)
+	ps.decisions.clear()
+}
+
+func (ps *PolicySelector) ASNDB() *geoip2.Reader {
+	return ps.asnDB.Load()
+}
+
+// SetCountryOnly 为 true 时只做 Country 查询，城市名规则不再命中
+func (ps *PolicySelector) SetCountryOnly(countryOnly bool) {
+	ps.countryOnly.Store(countryOnly)
+	ps.decisions.clear()
+}
+
+// compile 校验规则并预处理域名规则的值
+func (p *Policy) compile() error {
+	if err := p.compileAction(); err != nil {
 		return err
 	}
+	switch p.Type {
+	case IPPolicy:
+		if _, _, err := parseTrieCIDR(p.Value); err != nil {
+			return err
+		}
+	case LocationPolicy, MatchPolicy:
+	case CountryPolicy, ContinentPolicy:
+		p.Value = strings.ToUpper(strings.TrimSpace(p.Value))
+		if p.Value == "" {
+			return fmt.Errorf("empty %s code", p.Type)
+		}
+	case ASNPolicy:
+		asn, err := parseASN(p.Value)
+		if err != nil {
+			return err
+		}
+		p.asn = asn
+	case DomainPolicy, DomainSuffixPolicy, DomainKeywordPolicy:
+		// ".google.com" 形式的 domain 规则等价于 domain-suffix
+		if p.Type == DomainPolicy && strings.HasPrefix(p.Value, ".") {
+			p.Type = DomainSuffixPolicy
+		}
+		value := strings.TrimPrefix(p.Value, ".")
+		if p.Type == DomainKeywordPolicy {
+			p.Value = strings.ToLower(value)
+			return nil
+		}
+		p.Value = normalizeDomain(value)
+	case DomainRegexPolicy:
+		regex, err := regexp.Compile(p.Value)
+		if err != nil {
+			return err
+		}
+		p.regex = regex
+	case ProcessPolicy, UIDPolicy:
+		return p.compileProcess()
+	case ScriptPolicy:
+		return p.compileScript()
+	default:
+		return fmt.Errorf("unknown policy type %q", p.Type)
+	}
+	return nil
+}
 
-	// 赋值给 PolicySelector
-	ps.policies = policies
+func (p *Policy) compileAction() error {
+	action := strings.ToUpper(strings.TrimSpace(p.Action))
+	p.node = ""
+	switch {
+	case action == "" && p.IsProxy == Direct:
+		p.action = ActionDirect
+	case action == "":
+		p.action = ActionProxy
+	case action == ActionProxy, action == ActionDirect, action == ActionReject, action == ActionDrop:
+		p.action = action
+	case strings.HasPrefix(action, ActionProxy+":"):
+		p.action = ActionProxy
+		p.node = strings.TrimSpace(strings.TrimSpace(p.Action)[len(ActionProxy)+1:])
+		if p.node == "" {
+			return fmt.Errorf("empty node name in action %q", p.Action)
+		}
+	default:
+		return fmt.Errorf("unknown action %q", p.Action)
+	}
 	return nil
 }
 
-func (ps *PolicySelector) Select(remoteConn, localConn net.Conn, info *ProxyInfo) (net.Conn, error) {
-	switch info.AddrType {
-	case Ipv4:
-		return ps.handshakeIpv4(remoteConn, localConn, info)
+// Act 返回规则的动作，以及 PROXY:<节点名> 中指定的节点
+func (p *Policy) Act() (action string, node string) {
+	return p.action, p.node
+}
 
+func (ps *PolicySelector) Select(dialServer ServerDialer, localConn net.Conn, info *ProxyInfo) (net.Conn, error) {
+	if info.Source == "" {
+		info.Source = localConn.RemoteAddr().String()
+	}
+	ps.rewriteHost(info)
+	switch info.AddrType {
+	case Ipv4, Ipv6, Domain:
+		return ps.handshake(dialServer, localConn, info)
+	default:
+		return nil, fmt.Errorf("unknown address type %d", info.AddrType)
 	}
 }
 
-func (ps *PolicySelector) handshakeIpv4(remoteConn, localConn net.Conn, info *ProxyInfo) (net.Conn, error) {
-	policy := ps.findIpAndLocationPolicy(info.Addr)
-	if policy.IsProxy==Direct {
-		_=remoteConn.Close()
+func (ps *PolicySelector) handshake(dialServer ServerDialer, localConn net.Conn, info *ProxyInfo) (net.Conn, error) {
+	policy := ps.route(info)
+	action, node := policy.Act()
+	from := localConn.RemoteAddr().String()
+	switch action {
+	case ActionReject:
+		_, _ = localConn.Write(info.getRejectReply())
+		dlog.Info("%s", proxyLog(action, from, info.Addr))
+		return nil, ErrPolicyReject
+	case ActionDrop:
+		dlog.Info("%s", proxyLog(action, from, info.Addr))
+		return nil, ErrPolicyDrop
+	case ActionDirect:
 		proxyConn, err := ps.EstablishDirectConn(localConn, info)
 		if err != nil {
 			return nil, err
 		}
-		dlog.Info("%s",proxyLog(policy.IsProxy,localConn.RemoteAddr().String(), proxyConn.RemoteAddr().String())
+		dlog.Info("%s", proxyLog(action, from, info.Addr))
+		return proxyConn, nil
 	}
 
-
+	remoteConn, err := dialServer(node)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrServerUnavailable, err)
+	}
+	err = ps.EstablishProxyConn(remoteConn, localConn, info)
+	if err != nil {
+		_ = remoteConn.Close()
+		return nil, err
+	}
+	if node != "" {
+		action = ActionProxy + ":" + node
+	}
+	dlog.Info("%s", proxyLog(action, from, info.Addr))
+	return remoteConn, nil
 }
 
-func proxyLog(proxy int, from string, to string) any {
-
+func proxyLog(action string, from string, to string) string {
+	return fmt.Sprintf("[%s] %s -> %s", strings.ToLower(action), from, to)
 }
 
-
-
-func (ps *PolicySelector) findIpAndLocationPolicy(addr string) *Policy {
-	for _, p := range ps.policies {
-		if p.Type == IPPolicy {
-			ok, err := matchIp(p.Value, addr)
-			if err != nil {
-				dlog.Error("policy error: %s", err)
-			}
-			if ok {
-				return p
-			}
+// findPolicy 按顺序匹配规则，域名目标只匹配域名规则，IP 目标只匹配 IP 和地理位置规则。
+// 规则列表以 match 结尾，所以不会返回 nil。结果按 host:port 缓存，并记录规则命中次数
+func (ps *PolicySelector) findPolicy(info *ProxyInfo) *Policy {
+	set := ps.policies.Load()
+	if set == nil {
+		return defaultPolicy
+	}
+	key := info.Addr
+	i, ok := ps.decisions.get(key, set)
+	if !ok {
+		gen := ps.decisions.generation()
+		var cacheable bool
+		i, cacheable = ps.lookupIndex(set, info)
+		if cacheable {
+			ps.decisions.put(key, set, i, gen)
 		}
+	}
+	set.hits[i].hit()
+	return set.policies[i]
+}
 
-		if p.Type == LocationPolicy {
-			ok, err := matchLocation(p.Value, addr, ps.MMDB)
-			if err != nil {
-				dlog.Error("policy error: %s", err)
-			}
-			if ok {
-				return p
-			}
-		}
+// lookupIndex 不经过缓存查找规则，目标无效或结果取决于来源进程时不应缓存
+func (ps *PolicySelector) lookupIndex(set *policySet, info *ProxyInfo) (int, bool) {
+	t, err := ps.newTarget(info)
+	if err != nil {
+		dlog.Error("policy error: %s", err)
+		return set.match, false
+	}
+	i := set.lookup(t)
+	// 查过进程或执行过脚本时结果还取决于来源和时间，不能按目标缓存；
+	// DNS 解析失败时 Resolve 规则没有参与匹配，结果只能等 DNS 失败缓存过期后重新计算
+	return i, !t.procDone && !t.scriptRan && t.resolveErr == nil
+}
 
+func (ps *PolicySelector) newTarget(info *ProxyInfo) (*matchTarget, error) {
+	t := &matchTarget{
+		mmdb:        ps.MMDB(),
+		asnDB:       ps.ASNDB(),
+		countryOnly: ps.countryOnly.Load(),
+		resolveAll:  ps.resolveAll.Load(),
+		resolver:    ps.resolve,
+		source:      info.Source,
+		processes:   ps.processes.lookup,
 	}
-	return nil
+	host, port, err := net.SplitHostPort(info.Addr)
+	if err != nil {
+		host = info.Addr
+	}
+	t.port, _ = strconv.Atoi(port)
+	if info.AddrType == Domain {
+		t.domain = normalizeDomain(host)
+		return t, nil
+	}
+	t.ip = net.ParseIP(host)
+	if t.ip == nil {
+		return nil, fmt.Errorf("can not parse Ip :%s", host)
+	}
+	return t, nil
 }
 
 // 告诉本地连接开始发送正常数据
 func (ps *PolicySelector) localReady(conn net.Conn, info *ProxyInfo) error {
-	if info.ProxyType==HttpProxy{
+	if info.ProxyType == HttpProxy {
 		return nil
 	}
 	reply := info.getSuccessReply()
-	_,err:=conn.Write(reply)
+	_, err := conn.Write(reply)
 	return err
 }
 
 func (ps *PolicySelector) EstablishDirectConn(localConn net.Conn, info *ProxyInfo) (net.Conn, error) {
-	dial, err := net.Dial("tcp", info.Addr)
+	dial, err := net.DialTimeout("tcp", info.Addr, directDialTimeout)
 	if err != nil {
-		return nil, fmt.Errorf("failed to establish direct conn: %s",err)
+		return nil, fmt.Errorf("failed to establish direct conn: %w", err)
 	}
-	err = ps.localReady(localConn, info)
-	return dial,err
+	err = ps.establish(localConn, dial, info)
+	if err != nil {
+		_ = dial.Close()
+		return nil, err
+	}
+	return dial, nil
 }
 
-func matchLocation(locationName string, ip string, mmdb *geoip2.Reader) (bool, error) {
-	// 去掉IP地址中的端口部分（如果有）
-	ip = strings.Split(ip, ":")[0]
-
-	// 查询IP地址的地理位置信息
-	record, err := mmdb.City(net.ParseIP(ip))
+// EstablishProxyConn 等服务器连接目标成功后才回复本地应用，失败时返回 ConnectError
+func (ps *PolicySelector) EstablishProxyConn(remoteConn, localConn net.Conn, info *ProxyInfo) error {
+	err := requestConnect(remoteConn, info.Addr)
 	if err != nil {
-		return false, fmt.Errorf("failed to query location: %v", err)
+		return err
+	}
+	return ps.establish(localConn, remoteConn, info)
+}
+
+// establish 回复本地应用连接成功后发送 InitialData，回复之后的错误都包装为 ErrEstablished
+func (ps *PolicySelector) establish(localConn, remoteConn net.Conn, info *ProxyInfo) error {
+	err := ps.localReady(localConn, info)
+	if err == nil && len(info.InitialData) > 0 {
+		_, err = remoteConn.Write(info.InitialData)
 	}
+	if err != nil && info.ProxyType != HttpProxy {
+		// 普通 HTTP 代理没有成功回复，仍然可以回复错误状态
+		return fmt.Errorf("%w: %w", ErrEstablished, err)
+	}
+	return err
+}
+
+func matchDomain(p *Policy, domain string) bool {
+	switch p.Type {
+	case DomainPolicy:
+		return domain == p.Value
+	case DomainSuffixPolicy:
+		return domain == p.Value || strings.HasSuffix(domain, "."+p.Value)
+	case DomainKeywordPolicy:
+		return strings.Contains(domain, p.Value)
+	case DomainRegexPolicy:
+		return p.regex != nil && p.regex.MatchString(domain)
+	}
+	return false
+}
 
-	// 获取国家名称和城市名称
-	countryName := record.Country.Names["en"] // 使用英文名称
-	cityName := record.City.Names["en"]      // 使用英文名称
+// domainProfile 与 idna.Lookup 相同，但不检查 STD3 规则和连字符的位置，
+// 否则 r3---sn-ab5l6nzr.googlevideo.com 和带下划线的主机名会转换失败
+var domainProfile = idna.New(idna.MapForLookup(), idna.BidiRule(), idna.CheckJoiners(true),
+	idna.StrictDomainName(false), idna.CheckHyphens(false))
 
-	// 判断是否匹配
-	if strings.EqualFold(countryName, locationName) || strings.EqualFold(cityName, locationName) {
-		return true, nil
+// normalizeDomain 将域名转换为小写的 punycode 形式，去掉末尾的点。
+// 转换失败时使用小写的原始名字，不能因此跳过所有域名规则
+func normalizeDomain(domain string) string {
+	domain = strings.TrimSuffix(strings.TrimSpace(domain), ".")
+	ascii, err := domainProfile.ToASCII(domain)
+	if err != nil {
+		return strings.ToLower(domain)
 	}
+	return strings.ToLower(ascii)
+}
 
-	// 如果不匹配，返回false
-	return false, nil
+// splitHost 去掉地址中的端口部分（如果有）
+func splitHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
 }
 
-func matchIp(cidr, ipv4 string) (bool, error) {
-	// 去掉IP地址中的端口部分（如果有）
-	ip := strings.Split(ipv4, ":")[0]
+// match 逐条匹配单个规则，与 policySet.lookup 的结果保持一致
+func (p *Policy) match(t *matchTarget) (bool, error) {
+	if isIpPolicy(p.Type) && t.ip == nil {
+		if t.domain == "" || !(p.Resolve || t.resolveAll) {
+			return false, nil
+		}
+		targets, err := t.resolvedTargets()
+		if err != nil {
+			return false, fmt.Errorf("failed to resolve %s: %v", t.domain, err)
+		}
+		for _, rt := range targets {
+			if ok, _ := p.match(rt); ok {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	switch p.Type {
+	case MatchPolicy:
+		return true, nil
+	case IPPolicy:
+		return matchIp(p.Value, t.ip)
+	case LocationPolicy, CountryPolicy, ContinentPolicy:
+		record, err := t.geo()
+		if err != nil {
+			return false, fmt.Errorf("failed to query location: %v", err)
+		}
+		switch p.Type {
+		case CountryPolicy:
+			return strings.EqualFold(p.Value, record.CountryCode), nil
+		case ContinentPolicy:
+			return strings.EqualFold(p.Value, record.ContinentCode), nil
+		}
+		return matchLocationName(p.Value, record), nil
+	case ASNPolicy:
+		record, err := t.asn()
+		if err != nil {
+			return false, fmt.Errorf("failed to query asn: %v", err)
+		}
+		return record.Number == p.asn, nil
+	case ProcessPolicy, UIDPolicy:
+		proc, err := t.process()
+		if err != nil {
+			return false, fmt.Errorf("failed to find process: %v", err)
+		}
+		if p.Type == UIDPolicy {
+			return proc.UID == p.uid, nil
+		}
+		return matchProcess(p, proc), nil
+	case ScriptPolicy:
+		return p.runScript(t)
+	default:
+		if t.domain == "" {
+			return false, nil
+		}
+		return matchDomain(p, t.domain), nil
+	}
+}
 
+func matchIp(cidr string, ip net.IP) (bool, error) {
 	// 解析CIDR网段
 	_, ipNet, err := net.ParseCIDR(cidr)
 	if err != nil {
 		return false, err
 	}
 
-	// 解析IPv4地址
-	parsedIP := net.ParseIP(ip)
-	if parsedIP == nil {
-		return false, fmt.Errorf("can not parse Ip :%s", ip)
-	}
-
 	// 检查IP是否属于CIDR网段
-	return ipNet.Contains(parsedIP), nil
+	return ipNet.Contains(ip), nil
 }
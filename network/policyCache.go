@@ -0,0 +1,170 @@
+package network
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	decisionCacheSize = 4096
+	// 解析后的地址可能变化，决策和 DNS 缓存同时过期
+	decisionCacheTTL = resolveCacheTTL
+)
+
+type decisionEntry struct {
+	key     string
+	set     *policySet
+	index   int
+	expires time.Time
+}
+
+// decisionCache 是以 host:port 为键的 LRU，缓存命中规则的下标。
+// 规则、MMDB 或解析配置变化时清空，gen 防止清空前开始的查询写回旧结果
+type decisionCache struct {
+	mutex   sync.Mutex
+	size    int
+	gen     uint64
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+func (c *decisionCache) generation() uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.gen
+}
+
+func (c *decisionCache) get(key string, set *policySet) (int, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return 0, false
+	}
+	e := el.Value.(*decisionEntry)
+	if e.set != set || time.Now().After(e.expires) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return 0, false
+	}
+	c.order.MoveToFront(el)
+	return e.index, true
+}
+
+func (c *decisionCache) put(key string, set *policySet, index int, gen uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if gen != c.gen || c.size < 0 {
+		return
+	}
+	if c.entries == nil {
+		c.entries = make(map[string]*list.Element)
+		c.order = list.New()
+	}
+	expires := time.Now().Add(decisionCacheTTL)
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*decisionEntry)
+		e.set, e.index, e.expires = set, index, expires
+		c.order.MoveToFront(el)
+		return
+	}
+	size := c.size
+	if size == 0 {
+		size = decisionCacheSize
+	}
+	for c.order.Len() >= size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*decisionEntry).key)
+	}
+	c.entries[key] = c.order.PushFront(&decisionEntry{key: key, set: set, index: index, expires: expires})
+}
+
+func (c *decisionCache) clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.gen++
+	c.entries = nil
+	c.order = nil
+}
+
+func (c *decisionCache) len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.entries)
+}
+
+// SetDecisionCacheSize 设置路由决策缓存的容量，小于 0 时关闭缓存，0 表示默认值
+func (ps *PolicySelector) SetDecisionCacheSize(size int) {
+	ps.decisions.mutex.Lock()
+	ps.decisions.size = size
+	ps.decisions.mutex.Unlock()
+	ps.decisions.clear()
+}
+
+// ruleHit 记录一条规则的命中次数和最后命中时间（UnixNano）
+type ruleHit struct {
+	count atomic.Uint64
+	last  atomic.Int64
+}
+
+func (h *ruleHit) hit() {
+	h.count.Add(1)
+	h.last.Store(time.Now().UnixNano())
+}
+
+// RuleStat 是一条规则的命中统计，Hits 为 0 的规则可以考虑删除
+type RuleStat struct {
+	Index   int
+	Policy  *Policy
+	Hits    uint64
+	LastHit time.Time
+}
+
+// RuleStats 返回当前规则列表中每条规则的命中统计。
+// 重新加载后相同的规则（类型、值、动作都相同）保留原来的统计
+func (ps *PolicySelector) RuleStats() []RuleStat {
+	set := ps.policies.Load()
+	if set == nil {
+		return nil
+	}
+	stats := make([]RuleStat, len(set.policies))
+	for i, p := range set.policies {
+		stats[i] = RuleStat{Index: i, Policy: p, Hits: set.hits[i].count.Load()}
+		if last := set.hits[i].last.Load(); last != 0 {
+			stats[i].LastHit = time.Unix(0, last)
+		}
+	}
+	return stats
+}
+
+func ruleKey(p *Policy) string {
+	resolve := ""
+	if p.Resolve {
+		resolve = "resolve"
+	}
+	return p.Type + "\x00" + p.Value + "\x00" + p.action + "\x00" + p.node + "\x00" + resolve
+}
+
+// inheritStats 让新规则集中与旧规则相同的规则沿用旧的计数器
+func (s *policySet) inheritStats(old *policySet) {
+	if old == nil {
+		return
+	}
+	counters := make(map[string]*ruleHit, len(old.policies))
+	for i, p := range old.policies {
+		key := ruleKey(p)
+		if _, ok := counters[key]; !ok {
+			counters[key] = old.hits[i]
+		}
+	}
+	for i, p := range s.policies {
+		key := ruleKey(p)
+		if h, ok := counters[key]; ok {
+			s.hits[i] = h
+			delete(counters, key)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package network
+
+import (
+	"testing"
+)
+
+func TestDecisionCacheEviction(t *testing.T) {
+	set := &policySet{}
+	c := &decisionCache{size: 2}
+	c.put("a:80", set, 1, c.generation())
+	c.put("b:80", set, 2, c.generation())
+	c.get("a:80", set)
+	c.put("c:80", set, 3, c.generation())
+	if _, ok := c.get("b:80", set); ok {
+		t.Error("least recently used entry was not evicted")
+	}
+	if i, ok := c.get("a:80", set); !ok || i != 1 {
+		t.Errorf("got %d %v", i, ok)
+	}
+	if _, ok := c.get("a:80", &policySet{}); ok {
+		t.Error("entry of another policy set was returned")
+	}
+
+	gen := c.generation()
+	c.clear()
+	c.put("d:80", set, 4, gen)
+	if c.len() != 0 {
+		t.Error("stale result was cached after clear")
+	}
+}
+
+func TestRuleStats(t *testing.T) {
+	policies := []*Policy{
+		{Type: DomainPolicy, Value: ".example.com", IsProxy: Direct},
+		{Type: DomainPolicy, Value: ".unused.com", IsProxy: Direct},
+		{Type: MatchPolicy, IsProxy: UseProxy},
+	}
+	ps := newTestSelector(t, policies)
+	for i := 0; i < 3; i++ {
+		if got := ps.findPolicy(&ProxyInfo{AddrType: Domain, Addr: "www.example.com:443"}); got != policies[0] {
+			t.Fatalf("got %+v", got)
+		}
+	}
+	ps.findPolicy(&ProxyInfo{AddrType: Domain, Addr: "other.org:443"})
+	if ps.decisions.len() != 2 {
+		t.Errorf("cache has %d entries, want 2", ps.decisions.len())
+	}
+
+	stats := ps.RuleStats()
+	if stats[0].Hits != 3 || stats[1].Hits != 0 || stats[2].Hits != 1 {
+		t.Fatalf("hits: %d %d %d", stats[0].Hits, stats[1].Hits, stats[2].Hits)
+	}
+	if stats[0].LastHit.IsZero() || !stats[1].LastHit.IsZero() {
+		t.Error("unexpected last hit time")
+	}
+
+	// 重新加载后缓存失效，未变的规则保留统计
+	reloaded := []*Policy{
+		{Type: DomainPolicy, Value: ".example.com", IsProxy: UseProxy},
+		{Type: MatchPolicy, IsProxy: UseProxy},
+	}
+	if err := ps.SetPolicies(reloaded); err != nil {
+		t.Fatal(err)
+	}
+	if got := ps.findPolicy(&ProxyInfo{AddrType: Domain, Addr: "www.example.com:443"}); got != reloaded[0] {
+		t.Fatalf("cached decision survived reload: %+v", got)
+	}
+	stats = ps.RuleStats()
+	if stats[0].Hits != 1 || stats[1].Hits != 1 {
+		t.Errorf("hits after reload: %d %d", stats[0].Hits, stats[1].Hits)
+	}
+}
@@ -0,0 +1,508 @@
+package network
+
+import (
+	"Draylix2/dlog"
+	"fmt"
+	"github.com/oschwald/geoip2-golang"
+	"net"
+	"path/filepath"
+	"strings"
+)
+
+// policySet 是加载时编译好的规则集合，查询结果与按顺序逐条匹配相同（取下标最小的命中规则）
+type policySet struct {
+	policies []*Policy
+	hits     []*ruleHit
+
+	ipv4       *ipTrie
+	ipv6       *ipTrie
+	locations  []int
+	countries  map[string]int
+	continents map[string]int
+	asns       map[uint]int
+	ipFirst    int // 最靠前的 IP、地理位置或 asn 规则下标，没有则为 -1
+	geo        int // 最靠前的地理位置规则下标，没有则为 -1
+	asn        int // 最靠前的 asn 规则下标，没有则为 -1
+	match      int // 最后的 match 规则下标
+
+	processNames map[string]int
+	processPaths map[string]int
+	uids         map[uint32]int
+	processFirst int // 最靠前的 process 或 uid 规则下标，没有则为 -1
+
+	domains  map[string]int
+	suffixes *domainTrie
+	keywords []int
+	regexes  []int
+	scripts  []int
+
+	// resolved 只包含设置了 Resolve 的 IP 和地理位置规则，用于解析后的域名目标
+	resolved *policySet
+}
+
+func newPolicySet(policies []*Policy) *policySet {
+	return &policySet{
+		policies:   policies,
+		ipv4:       newIpTrie(),
+		ipv6:       newIpTrie(),
+		countries:  make(map[string]int),
+		continents: make(map[string]int),
+		asns:       make(map[uint]int),
+		ipFirst:    -1,
+		geo:        -1,
+		asn:        -1,
+		match:      -1,
+
+		processNames: make(map[string]int),
+		processPaths: make(map[string]int),
+		uids:         make(map[uint32]int),
+		processFirst: -1,
+
+		domains:  make(map[string]int),
+		suffixes: newDomainTrie(),
+	}
+}
+
+// compilePolicies 要求规则列表以 match 规则结尾，match 之后的规则永远不会命中
+func compilePolicies(policies []*Policy) (*policySet, error) {
+	if len(policies) == 0 || policies[len(policies)-1].Type != MatchPolicy {
+		return nil, fmt.Errorf("policies must end with a %q rule", MatchPolicy)
+	}
+	s := newPolicySet(policies)
+	s.resolved = newPolicySet(policies)
+	s.hits = make([]*ruleHit, len(policies))
+	for i := range s.hits {
+		s.hits[i] = &ruleHit{}
+	}
+	for i, p := range policies {
+		if err := p.compile(); err != nil {
+			return nil, &PolicyError{Index: i, Policy: p, Err: err}
+		}
+		if p.Type == MatchPolicy && i != len(policies)-1 {
+			return nil, &PolicyError{Index: i, Policy: p, Err: fmt.Errorf("%q rule must be the last one", MatchPolicy)}
+		}
+		s.add(i, p)
+		if p.Resolve && isIpPolicy(p.Type) {
+			s.resolved.add(i, p)
+		}
+	}
+	return s, nil
+}
+
+func (s *policySet) add(i int, p *Policy) {
+	first := func(m map[string]int, key string) {
+		if _, ok := m[key]; !ok {
+			m[key] = i
+		}
+	}
+	if isIpPolicy(p.Type) && s.ipFirst < 0 {
+		s.ipFirst = i
+	}
+	switch p.Type {
+	case IPPolicy:
+		ip, ones, _ := parseTrieCIDR(p.Value)
+		if len(ip) == net.IPv4len {
+			s.ipv4.insert(ip, ones, i)
+		} else {
+			s.ipv6.insert(ip, ones, i)
+		}
+	case LocationPolicy, CountryPolicy, ContinentPolicy:
+		switch p.Type {
+		case LocationPolicy:
+			s.locations = append(s.locations, i)
+		case CountryPolicy:
+			first(s.countries, p.Value)
+		case ContinentPolicy:
+			first(s.continents, p.Value)
+		}
+		if s.geo < 0 {
+			s.geo = i
+		}
+	case ASNPolicy:
+		if _, ok := s.asns[p.asn]; !ok {
+			s.asns[p.asn] = i
+		}
+		if s.asn < 0 {
+			s.asn = i
+		}
+	case MatchPolicy:
+		s.match = i
+	case ProcessPolicy, UIDPolicy:
+		if p.Type == UIDPolicy {
+			if _, ok := s.uids[p.uid]; !ok {
+				s.uids[p.uid] = i
+			}
+		} else if strings.ContainsRune(p.Value, filepath.Separator) {
+			first(s.processPaths, p.Value)
+		} else {
+			first(s.processNames, p.Value)
+		}
+		if s.processFirst < 0 {
+			s.processFirst = i
+		}
+	case DomainPolicy:
+		first(s.domains, p.Value)
+	case DomainSuffixPolicy:
+		s.suffixes.insert(p.Value, i)
+	case DomainKeywordPolicy:
+		s.keywords = append(s.keywords, i)
+	case DomainRegexPolicy:
+		s.regexes = append(s.regexes, i)
+	case ScriptPolicy:
+		s.scripts = append(s.scripts, i)
+	}
+}
+
+// lookup 返回第一条命中的规则下标，都没有命中时返回最后的 match 规则
+func (s *policySet) lookup(t *matchTarget) int {
+	best := -1
+	if t.ip != nil {
+		best = s.lookupIp(t, best)
+	}
+	if t.domain != "" {
+		best = s.lookupDomain(t, best)
+	}
+	// 进程查询要读 /proc，只有更靠前的规则都没有命中时才查
+	if s.processFirst >= 0 && (best < 0 || s.processFirst < best) {
+		best = s.lookupProcess(t, best)
+	}
+	if t.domain != "" {
+		rs := s.resolved
+		if t.resolveAll {
+			rs = s
+		}
+		if rs.ipFirst >= 0 && (best < 0 || rs.ipFirst < best) {
+			targets, _ := t.resolvedTargets()
+			for _, rt := range targets {
+				best = rs.lookupIp(rt, best)
+			}
+		}
+	}
+	for _, i := range s.scripts {
+		if best >= 0 && i > best {
+			break
+		}
+		t.scriptRan = true
+		ok, err := s.policies[i].runScript(t)
+		if err != nil {
+			dlog.Warn("script rule #%d: %s", i, err)
+			continue
+		}
+		if ok {
+			best = i
+			break
+		}
+	}
+	if best < 0 {
+		best = s.match
+	}
+	return best
+}
+
+// lookupIp 在 IP、地理位置和 asn 规则中查找比 best 更靠前的命中规则
+func (s *policySet) lookupIp(t *matchTarget, best int) int {
+	better := func(i int) {
+		if i >= 0 && (best < 0 || i < best) {
+			best = i
+		}
+	}
+	before := func(i int) bool {
+		return best < 0 || i < best
+	}
+
+	if ip4 := t.ip.To4(); ip4 != nil {
+		better(s.ipv4.lookup(ip4))
+	} else {
+		better(s.ipv6.lookup(t.ip))
+	}
+	if s.geo >= 0 && before(s.geo) {
+		if record, err := t.geo(); err == nil {
+			if i, ok := s.countries[strings.ToUpper(record.CountryCode)]; ok {
+				better(i)
+			}
+			if i, ok := s.continents[strings.ToUpper(record.ContinentCode)]; ok {
+				better(i)
+			}
+			for _, i := range s.locations {
+				if !before(i) {
+					break
+				}
+				if matchLocationName(s.policies[i].Value, record) {
+					better(i)
+					break
+				}
+			}
+		}
+	}
+	if s.asn >= 0 && before(s.asn) {
+		if record, err := t.asn(); err == nil {
+			if i, ok := s.asns[record.Number]; ok {
+				better(i)
+			}
+		}
+	}
+	return best
+}
+
+// lookupDomain 在域名规则中查找比 best 更靠前的命中规则
+func (s *policySet) lookupDomain(t *matchTarget, best int) int {
+	better := func(i int) {
+		if i >= 0 && (best < 0 || i < best) {
+			best = i
+		}
+	}
+	before := func(i int) bool {
+		return best < 0 || i < best
+	}
+
+	if i, ok := s.domains[t.domain]; ok {
+		better(i)
+	}
+	better(s.suffixes.lookup(t.domain))
+	for _, i := range s.keywords {
+		if !before(i) {
+			break
+		}
+		if strings.Contains(t.domain, s.policies[i].Value) {
+			better(i)
+			break
+		}
+	}
+	for _, i := range s.regexes {
+		if !before(i) {
+			break
+		}
+		if s.policies[i].regex.MatchString(t.domain) {
+			better(i)
+			break
+		}
+	}
+	return best
+}
+
+// lookupProcess 在 process 和 uid 规则中查找比 best 更靠前的命中规则
+func (s *policySet) lookupProcess(t *matchTarget, best int) int {
+	proc, err := t.process()
+	if err != nil {
+		return best
+	}
+	candidates := []int{-1, -1, -1}
+	if proc.Path != "" {
+		if i, ok := s.processPaths[proc.Path]; ok {
+			candidates[0] = i
+		}
+	}
+	if proc.Name != "" {
+		if i, ok := s.processNames[proc.Name]; ok {
+			candidates[1] = i
+		}
+	}
+	if i, ok := s.uids[proc.UID]; ok {
+		candidates[2] = i
+	}
+	for _, i := range candidates {
+		if i >= 0 && (best < 0 || i < best) {
+			best = i
+		}
+	}
+	return best
+}
+
+func isIpPolicy(policyType string) bool {
+	switch policyType {
+	case IPPolicy, LocationPolicy, CountryPolicy, ContinentPolicy, ASNPolicy:
+		return true
+	}
+	return false
+}
+
+// matchTarget 是一次路由查询的目标，GeoIP、ASN 和 DNS 在一次查询中各最多查一次
+type matchTarget struct {
+	domain string
+	ip     net.IP
+
+	mmdb        *geoip2.Reader
+	asnDB       *geoip2.Reader
+	countryOnly bool
+	resolveAll  bool
+	resolver    func(domain string) ([]net.IP, error)
+	port        int
+	source      string
+	processes   func(source string) (*ProcessInfo, error)
+
+	resolved    []*matchTarget
+	resolveErr  error
+	resolveDone bool
+
+	geoRecord *GeoRecord
+	geoErr    error
+	geoDone   bool
+	asnRecord *ASNRecord
+	asnErr    error
+	asnDone   bool
+
+	proc     *ProcessInfo
+	procErr  error
+	procDone bool
+
+	// scriptRan 表示查询执行过脚本规则，结果可能取决于时间和来源
+	scriptRan bool
+}
+
+func (t *matchTarget) process() (*ProcessInfo, error) {
+	if !t.procDone {
+		t.procDone = true
+		if t.processes == nil {
+			t.procErr = errProcessUnsupported
+		} else {
+			t.proc, t.procErr = t.processes(t.source)
+		}
+	}
+	return t.proc, t.procErr
+}
+
+func (t *matchTarget) geo() (*GeoRecord, error) {
+	if !t.geoDone {
+		t.geoDone = true
+		t.geoRecord, t.geoErr = lookupGeo(t.mmdb, t.ip, t.countryOnly)
+	}
+	return t.geoRecord, t.geoErr
+}
+
+// resolvedTargets 解析域名，为每个地址生成一个 IP 目标
+func (t *matchTarget) resolvedTargets() ([]*matchTarget, error) {
+	if !t.resolveDone {
+		t.resolveDone = true
+		if t.resolver == nil {
+			t.resolveErr = errNoResolver
+			return nil, t.resolveErr
+		}
+		var ips []net.IP
+		ips, t.resolveErr = t.resolver(t.domain)
+		for _, ip := range ips {
+			t.resolved = append(t.resolved, &matchTarget{
+				ip:          ip,
+				mmdb:        t.mmdb,
+				asnDB:       t.asnDB,
+				countryOnly: t.countryOnly,
+			})
+		}
+	}
+	return t.resolved, t.resolveErr
+}
+
+func (t *matchTarget) asn() (*ASNRecord, error) {
+	if !t.asnDone {
+		t.asnDone = true
+		t.asnRecord, t.asnErr = lookupASN(t.asnDB, t.ip)
+	}
+	return t.asnRecord, t.asnErr
+}
+
+type ipTrieNode struct {
+	children [2]*ipTrieNode
+	index    int
+}
+
+// ipTrie 是按比特展开的 CIDR 前缀树，每个节点记录在此结束的最靠前规则
+type ipTrie struct {
+	root *ipTrieNode
+}
+
+func newIpTrie() *ipTrie {
+	return &ipTrie{root: &ipTrieNode{index: -1}}
+}
+
+// parseTrieCIDR 返回前缀树使用的地址和前缀长度，
+// IPv4 映射的 IPv6 前缀（例如 ::ffff:10.0.0.0/104）转换为 IPv4 前缀
+func parseTrieCIDR(value string) (net.IP, int, error) {
+	_, ipNet, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil, 0, err
+	}
+	ip := ipNet.IP
+	ones, bits := ipNet.Mask.Size()
+	if ip4 := ip.To4(); ip4 != nil && bits == 8*net.IPv6len && ones >= 96 {
+		ip, ones, bits = ip4, ones-96, 8*net.IPv4len
+	}
+	if len(ip)*8 != bits || ones > bits {
+		return nil, 0, fmt.Errorf("invalid prefix length in %s", value)
+	}
+	return ip, ones, nil
+}
+
+func (t *ipTrie) insert(ip net.IP, ones int, index int) {
+	node := t.root
+	for i := 0; i < ones; i++ {
+		bit := ip[i/8] >> (7 - uint(i%8)) & 1
+		if node.children[bit] == nil {
+			node.children[bit] = &ipTrieNode{index: -1}
+		}
+		node = node.children[bit]
+	}
+	if node.index < 0 || index < node.index {
+		node.index = index
+	}
+}
+
+func (t *ipTrie) lookup(ip net.IP) int {
+	best := -1
+	node := t.root
+	for i := 0; node != nil; i++ {
+		if node.index >= 0 && (best < 0 || node.index < best) {
+			best = node.index
+		}
+		if i == len(ip)*8 {
+			break
+		}
+		node = node.children[ip[i/8]>>(7-uint(i%8))&1]
+	}
+	return best
+}
+
+type domainTrieNode struct {
+	children map[string]*domainTrieNode
+	index    int
+}
+
+// domainTrie 按域名标签从右到左建树，用于 domain-suffix 规则
+type domainTrie struct {
+	root *domainTrieNode
+}
+
+func newDomainTrie() *domainTrie {
+	return &domainTrie{root: &domainTrieNode{index: -1}}
+}
+
+func (t *domainTrie) insert(suffix string, index int) {
+	node := t.root
+	labels := strings.Split(suffix, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		if node.children == nil {
+			node.children = make(map[string]*domainTrieNode)
+		}
+		child, ok := node.children[labels[i]]
+		if !ok {
+			child = &domainTrieNode{index: -1}
+			node.children[labels[i]] = child
+		}
+		node = child
+	}
+	if node.index < 0 || index < node.index {
+		node.index = index
+	}
+}
+
+func (t *domainTrie) lookup(domain string) int {
+	best := -1
+	node := t.root
+	for end := len(domain); end > 0 && node != nil; {
+		start := strings.LastIndexByte(domain[:end], '.') + 1
+		node = node.children[domain[start:end]]
+		if node != nil && node.index >= 0 && (best < 0 || node.index < best) {
+			best = node.index
+		}
+		end = start - 1
+	}
+	return best
+}
@@ -0,0 +1,147 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// RuleTrace 是 Explain 中单条规则的匹配结果
+type RuleTrace struct {
+	Index   int
+	Policy  *Policy
+	Matched bool
+	Err     error
+}
+
+// Explanation 记录一次路由决策的完整过程
+type Explanation struct {
+	Target string
+	// Original 是 hosts 改写前的目标，没有改写时为空
+	Original string
+	Domain   string
+	IP       net.IP
+	// Resolved 是域名目标的 DNS 解析结果，只有 Resolve 规则会用它匹配
+	Resolved   []net.IP
+	ResolveErr error
+	Geo        *GeoRecord
+	GeoErr     error
+	ASN        *ASNRecord
+	ASNErr     error
+	Rules      []RuleTrace
+	Policy     *Policy
+}
+
+// Explain 按顺序逐条匹配规则并记录每一步，最终结果与 Select 使用的规则一致
+func (ps *PolicySelector) Explain(info *ProxyInfo) (*Explanation, error) {
+	// 和 Select 一样先按 hosts 改写目标，不修改调用者的 info
+	rewritten := *info
+	ps.rewriteHost(&rewritten)
+	e := &Explanation{Target: rewritten.Addr}
+	if rewritten.Addr != info.Addr {
+		e.Original = info.Addr
+	}
+	info = &rewritten
+	t, err := ps.newTarget(info)
+	if err != nil {
+		return nil, err
+	}
+	e.Domain = t.domain
+	e.IP = t.ip
+
+	geoTarget := t
+	if t.domain != "" {
+		targets, err := t.resolvedTargets()
+		e.ResolveErr = err
+		for _, rt := range targets {
+			e.Resolved = append(e.Resolved, rt.ip)
+		}
+		if len(targets) > 0 {
+			geoTarget = targets[0]
+		}
+	}
+	if geoTarget.ip != nil {
+		e.Geo, e.GeoErr = geoTarget.geo()
+		e.ASN, e.ASNErr = geoTarget.asn()
+	}
+
+	for i, p := range ps.Policies() {
+		ok, err := p.match(t)
+		e.Rules = append(e.Rules, RuleTrace{Index: i, Policy: p, Matched: ok, Err: err})
+		if ok {
+			break
+		}
+	}
+	if set := ps.policies.Load(); set != nil {
+		i, _ := ps.lookupIndex(set, info)
+		e.Policy = set.policies[i]
+	} else {
+		e.Policy = defaultPolicy
+	}
+	return e, nil
+}
+
+func (e *Explanation) String() string {
+	b := &strings.Builder{}
+	if e.Original != "" {
+		fmt.Fprintf(b, "hosts:    %s -> %s\n", e.Original, e.Target)
+	}
+	fmt.Fprintf(b, "target:   %s\n", e.Target)
+	if e.Domain != "" {
+		fmt.Fprintf(b, "domain:   %s\n", e.Domain)
+		if e.ResolveErr != nil {
+			fmt.Fprintf(b, "dns:      %s\n", e.ResolveErr)
+		} else {
+			fmt.Fprintf(b, "dns:      %s\n", joinIPs(e.Resolved))
+		}
+	} else {
+		fmt.Fprintf(b, "ip:       %s\n", e.IP)
+	}
+	switch {
+	case e.GeoErr != nil:
+		fmt.Fprintf(b, "geoip:    %s\n", e.GeoErr)
+	case e.Geo != nil:
+		fmt.Fprintf(b, "geoip:    continent=%s country=%s (%s) city=%s\n", e.Geo.ContinentCode, e.Geo.CountryCode, e.Geo.Country, e.Geo.City)
+	}
+	if e.ASN != nil {
+		fmt.Fprintf(b, "asn:      AS%d %s\n", e.ASN.Number, e.ASN.Organization)
+	}
+
+	fmt.Fprintf(b, "rules:\n")
+	for _, r := range e.Rules {
+		result := "no match"
+		if r.Matched {
+			result = "MATCH"
+		}
+		if r.Err != nil {
+			result = fmt.Sprintf("error: %s", r.Err)
+		}
+		fmt.Fprintf(b, "  #%-5d %-15s %-30s %s\n", r.Index, r.Policy.Type, r.Policy.Value, result)
+	}
+	if e.Policy != nil {
+		action, node := e.Policy.Act()
+		if node != "" {
+			action = action + ":" + node
+		}
+		fmt.Fprintf(b, "action:   %s\n", action)
+	}
+	return b.String()
+}
+
+func joinIPs(ips []net.IP) string {
+	s := make([]string, len(ips))
+	for i, ip := range ips {
+		s[i] = ip.String()
+	}
+	return strings.Join(s, ", ")
+}
+
+// NewTargetInfo 根据 host[:port] 构造 ProxyInfo，没有端口时使用 80
+func NewTargetInfo(target string) *ProxyInfo {
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		host = strings.TrimSuffix(strings.TrimPrefix(target, "["), "]")
+		target = net.JoinHostPort(host, "80")
+	}
+	return &ProxyInfo{AddrType: AddrTypeOf(host), Addr: target}
+}
@@ -0,0 +1,308 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const (
+	DraylixFormat = "draylix"
+	ClashFormat   = "clash"
+	GfwlistFormat = "gfwlist"
+)
+
+// PolicySource 描述一个规则来源，多个来源按顺序拼接成一个规则列表
+type PolicySource struct {
+	Format string
+	File   string
+	// IsProxy 用于没有指定动作的条目，例如 Clash rule-provider 的 payload 和 gfwlist
+	IsProxy int
+}
+
+// LineError 表示规则文件中无法转换的一行
+type LineError struct {
+	File string
+	Line int
+	Text string
+	Err  error
+}
+
+func (e *LineError) Error() string {
+	return fmt.Sprintf("%s:%d: %s: %q", e.File, e.Line, e.Err, e.Text)
+}
+
+// LoadPolicySources 按顺序读取所有来源，返回转换后的规则和被跳过的行。
+// 来源中的 match 规则移到最后，多个时使用第一个；没有 match 规则时追加动作为 final 的 match 规则，
+// final 为空表示 PROXY。这样 gfwlist、Clash payload 等没有 match 的来源可以单独使用或放在其他来源之后
+func LoadPolicySources(sources []PolicySource, final string) ([]*Policy, []*LineError, error) {
+	var policies []*Policy
+	var skipped []*LineError
+	var match *Policy
+	for _, source := range sources {
+		p, s, err := source.Load()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load %s: %s", source.File, err)
+		}
+		for _, policy := range p {
+			if policy.Type != MatchPolicy {
+				policies = append(policies, policy)
+			} else if match == nil {
+				match = policy
+			}
+		}
+		skipped = append(skipped, s...)
+	}
+	if match == nil {
+		match = &Policy{Type: MatchPolicy, IsProxy: UseProxy, Action: final}
+	}
+	return append(policies, match), skipped, nil
+}
+
+// Load 读取单个来源，格式为空时按 Draylix JSON 处理
+func (s PolicySource) Load() ([]*Policy, []*LineError, error) {
+	data, err := os.ReadFile(s.File)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s.Parse(data)
+}
+
+// Parse 按来源的格式转换规则内容
+func (s PolicySource) Parse(data []byte) ([]*Policy, []*LineError, error) {
+	var err error
+	var policies []*Policy
+	var skipped []*LineError
+	switch s.Format {
+	case DraylixFormat, "":
+		err = json.Unmarshal(data, &policies)
+	case ClashFormat:
+		policies, skipped, err = ParseClashRules(bytes.NewReader(data), s.IsProxy)
+	case GfwlistFormat:
+		policies, skipped, err = ParseGfwlist(bytes.NewReader(data), s.IsProxy)
+	default:
+		err = fmt.Errorf("unknown policy format %q", s.Format)
+	}
+	for _, e := range skipped {
+		e.File = s.File
+	}
+	return policies, skipped, err
+}
+
+// LoadSources 读取并拼接多个规则来源，替换当前规则集，final 的含义见 LoadPolicySources
+func (ps *PolicySelector) LoadSources(sources []PolicySource, final string) ([]*LineError, error) {
+	policies, skipped, err := LoadPolicySources(sources, final)
+	if err != nil {
+		return nil, err
+	}
+	return skipped, ps.SetPolicies(policies)
+}
+
+type clashRules struct {
+	Rules   []yaml.Node `yaml:"rules"`
+	Payload []yaml.Node `yaml:"payload"`
+}
+
+// ParseClashRules 转换 Clash 配置中的 rules 或 rule-provider 的 payload，
+// 没有动作的 payload 条目使用 isProxy
+func ParseClashRules(r io.Reader, isProxy int) ([]*Policy, []*LineError, error) {
+	var doc clashRules
+	if err := yaml.NewDecoder(r).Decode(&doc); err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+	var policies []*Policy
+	var skipped []*LineError
+	for _, node := range append(doc.Rules, doc.Payload...) {
+		if node.Kind != yaml.ScalarNode {
+			skipped = append(skipped, &LineError{Line: node.Line, Text: node.Value, Err: fmt.Errorf("rule is not a string")})
+			continue
+		}
+		p, err := parseClashRule(node.Value, isProxy)
+		if err != nil {
+			skipped = append(skipped, &LineError{Line: node.Line, Text: node.Value, Err: err})
+			continue
+		}
+		policies = append(policies, p)
+	}
+	return policies, skipped, nil
+}
+
+func parseClashRule(rule string, isProxy int) (*Policy, error) {
+	fields := strings.Split(rule, ",")
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	if len(fields) == 1 {
+		return parseClashPayload(fields[0], isProxy)
+	}
+
+	ruleType := strings.ToUpper(fields[0])
+	if ruleType == "MATCH" || ruleType == "FINAL" {
+		p := &Policy{Type: MatchPolicy}
+		setClashAction(p, fields[1])
+		return p, p.compile()
+	}
+	p := &Policy{Value: fields[1], IsProxy: isProxy}
+	if len(fields) > 2 {
+		setClashAction(p, fields[2])
+	}
+	switch ruleType {
+	case "DOMAIN":
+		p.Type = DomainPolicy
+	case "DOMAIN-SUFFIX":
+		p.Type = DomainSuffixPolicy
+	case "DOMAIN-KEYWORD":
+		p.Type = DomainKeywordPolicy
+	case "DOMAIN-REGEX":
+		p.Type = DomainRegexPolicy
+	case "IP-CIDR", "IP-CIDR6":
+		p.Type = IPPolicy
+	case "GEOIP":
+		p.Type = CountryPolicy
+	case "IP-ASN":
+		p.Type = ASNPolicy
+	case "PROCESS-NAME", "PROCESS-PATH":
+		p.Type = ProcessPolicy
+	case "UID":
+		p.Type = UIDPolicy
+	default:
+		return nil, fmt.Errorf("unsupported rule type %s", ruleType)
+	}
+	// Clash 的 IP 规则默认解析域名目标后匹配，除非带有 no-resolve
+	if isIpPolicy(p.Type) {
+		p.Resolve = true
+		for _, option := range fields[min(len(fields), 3):] {
+			if strings.EqualFold(option, "no-resolve") {
+				p.Resolve = false
+			}
+		}
+	}
+	return p, p.compile()
+}
+
+// parseClashPayload 转换 domain / ipcidr 类型 rule-provider 中只有值的条目
+func parseClashPayload(value string, isProxy int) (*Policy, error) {
+	p := &Policy{Value: value, IsProxy: isProxy}
+	switch {
+	case strings.HasPrefix(value, "+."):
+		p.Type = DomainSuffixPolicy
+		p.Value = value[2:]
+	case strings.HasPrefix(value, "."):
+		p.Type = DomainSuffixPolicy
+	case strings.Contains(value, "/"):
+		p.Type = IPPolicy
+	case strings.Contains(value, "*"):
+		return nil, fmt.Errorf("unsupported wildcard domain")
+	default:
+		p.Type = DomainPolicy
+	}
+	return p, p.compile()
+}
+
+// setClashAction 转换 Clash 规则的目标，DIRECT 和 REJECT 以外的策略组都视为走代理
+func setClashAction(p *Policy, target string) {
+	switch strings.ToUpper(target) {
+	case "DIRECT":
+		p.IsProxy = Direct
+	case "REJECT":
+		p.Action = ActionReject
+	case "REJECT-DROP":
+		p.Action = ActionDrop
+	default:
+		p.IsProxy = UseProxy
+	}
+}
+
+// ParseGfwlist 转换 base64 编码的 gfwlist（AutoProxy/AdBlock 语法）。
+// 普通条目使用 isProxy，"@@" 例外条目使用相反的动作并排在最前面。
+func ParseGfwlist(r io.Reader, isProxy int) ([]*Policy, []*LineError, error) {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	text, err := base64.StdEncoding.DecodeString(string(bytes.Join(bytes.Fields(raw), nil)))
+	if err != nil {
+		// 允许直接使用解码后的明文
+		text = raw
+	}
+
+	exception := Direct
+	if isProxy == Direct {
+		exception = UseProxy
+	}
+	var exceptions, policies []*Policy
+	var skipped []*LineError
+	scanner := bufio.NewScanner(bytes.NewReader(text))
+	for line := 1; scanner.Scan(); line++ {
+		rule := strings.TrimSpace(scanner.Text())
+		if rule == "" || strings.HasPrefix(rule, "!") || strings.HasPrefix(rule, "[") {
+			continue
+		}
+		action := isProxy
+		if strings.HasPrefix(rule, "@@") {
+			action = exception
+		}
+		p, err := parseGfwRule(strings.TrimPrefix(rule, "@@"), action)
+		if err != nil {
+			skipped = append(skipped, &LineError{Line: line, Text: rule, Err: err})
+			continue
+		}
+		if action == exception {
+			exceptions = append(exceptions, p)
+		} else {
+			policies = append(policies, p)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	return append(exceptions, policies...), skipped, nil
+}
+
+func parseGfwRule(rule string, isProxy int) (*Policy, error) {
+	p := &Policy{Type: DomainSuffixPolicy, IsProxy: isProxy}
+	switch {
+	case strings.HasPrefix(rule, "/") && strings.HasSuffix(rule, "/"):
+		return nil, fmt.Errorf("unsupported url regex")
+	case strings.HasPrefix(rule, "||"):
+		p.Value = gfwHost(rule[2:])
+	case strings.HasPrefix(rule, "|"):
+		u, err := url.Parse(rule[1:])
+		if err != nil || u.Hostname() == "" {
+			return nil, fmt.Errorf("invalid url")
+		}
+		p.Type = DomainPolicy
+		p.Value = u.Hostname()
+	default:
+		p.Value = gfwHost(rule)
+	}
+	if p.Value == "" || strings.ContainsAny(p.Value, "*^|") {
+		return nil, fmt.Errorf("unsupported pattern")
+	}
+	if ip := net.ParseIP(p.Value); ip != nil {
+		bits := 32
+		if ip.To4() == nil {
+			bits = 128
+		}
+		p.Type = IPPolicy
+		p.Value = fmt.Sprintf("%s/%d", p.Value, bits)
+	}
+	return p, p.compile()
+}
+
+// gfwHost 取出规则中的主机部分，去掉路径和端口
+func gfwHost(rule string) string {
+	rule = strings.TrimPrefix(strings.TrimPrefix(rule, "http://"), "https://")
+	if i := strings.IndexAny(rule, "/^"); i >= 0 {
+		rule = rule[:i]
+	}
+	return splitHost(rule)
+}
@@ -0,0 +1,188 @@
+package network
+
+import (
+	"encoding/base64"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const clashConfig = `port: 7890
+rules:
+  - DOMAIN-SUFFIX,google.com,Proxy
+  - DOMAIN,example.com,DIRECT
+  - DOMAIN-KEYWORD,baidu,DIRECT
+  - PROCESS-NAME,steam,DIRECT
+  - DST-PORT,22,DIRECT
+  - DOMAIN-SUFFIX,ad.com,REJECT
+  - IP-CIDR,10.0.0.0/8,DIRECT,no-resolve
+  - GEOIP,CN,DIRECT
+  - IP-ASN,13335,Proxy,No-Resolve
+  - IP-CIDR6,2001:db8::/32,DIRECT
+  - MATCH,Proxy
+`
+
+func TestParseClashRules(t *testing.T) {
+	policies, skipped, err := ParseClashRules(strings.NewReader(clashConfig), UseProxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Policy{
+		{Type: DomainSuffixPolicy, Value: "google.com", IsProxy: UseProxy},
+		{Type: DomainPolicy, Value: "example.com", IsProxy: Direct},
+		{Type: DomainKeywordPolicy, Value: "baidu", IsProxy: Direct},
+		{Type: ProcessPolicy, Value: "steam", IsProxy: Direct},
+		{Type: DomainSuffixPolicy, Value: "ad.com", IsProxy: UseProxy, Action: ActionReject},
+		{Type: IPPolicy, Value: "10.0.0.0/8", IsProxy: Direct},
+		{Type: CountryPolicy, Value: "CN", IsProxy: Direct, Resolve: true},
+		{Type: ASNPolicy, Value: "13335", IsProxy: UseProxy},
+		{Type: IPPolicy, Value: "2001:db8::/32", IsProxy: Direct, Resolve: true},
+		{Type: MatchPolicy, IsProxy: UseProxy},
+	}
+	if len(policies) != len(want) {
+		t.Fatalf("got %d policies, want %d", len(policies), len(want))
+	}
+	for i, p := range policies {
+		if p.Type != want[i].Type || p.Value != want[i].Value || p.IsProxy != want[i].IsProxy || p.Action != want[i].Action || p.Resolve != want[i].Resolve {
+			t.Errorf("policy %d: got %+v, want %+v", i, p, want[i])
+		}
+	}
+	if len(skipped) != 1 || skipped[0].Line != 7 {
+		t.Fatalf("unexpected skipped lines: %v", skipped)
+	}
+}
+
+func TestParseClashPayload(t *testing.T) {
+	payload := "payload:\n  - '+.youtube.com'\n  - 'twitter.com'\n  - '91.108.4.0/22'\n"
+	policies, skipped, err := ParseClashRules(strings.NewReader(payload), UseProxy)
+	if err != nil || len(skipped) != 0 {
+		t.Fatal(err, skipped)
+	}
+	types := []string{DomainSuffixPolicy, DomainPolicy, IPPolicy}
+	for i, p := range policies {
+		if p.Type != types[i] || p.IsProxy != UseProxy {
+			t.Errorf("policy %d: got %+v", i, p)
+		}
+	}
+}
+
+const gfwlist = `[AutoProxy 0.2.9]
+! comment
+||google.com
+|http://www.example.org/path
+.twitter.com
+@@||cn.example.com
+/^https?:\/\/[^\/]+blogspot\.(.*)/
+1.2.3.4
+`
+
+func TestParseGfwlist(t *testing.T) {
+	encoded := base64.StdEncoding.EncodeToString([]byte(gfwlist))
+	policies, skipped, err := ParseGfwlist(strings.NewReader(encoded), UseProxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(skipped) != 1 || skipped[0].Line != 7 {
+		t.Fatalf("unexpected skipped lines: %v", skipped)
+	}
+	if len(policies) != 5 {
+		t.Fatalf("got %d policies", len(policies))
+	}
+
+	// 只有 gfwlist 一个来源时由 final 补上 match 规则
+	file := filepath.Join(t.TempDir(), "gfwlist.txt")
+	_ = os.WriteFile(file, []byte(encoded), 0644)
+	ps := &PolicySelector{}
+	if _, err := ps.LoadSources([]PolicySource{{Format: GfwlistFormat, File: file, IsProxy: UseProxy}}, ActionDirect); err != nil {
+		t.Fatal(err)
+	}
+	if p := ps.findPolicy(&ProxyInfo{AddrType: Domain, Addr: "other.org:443"}); p.Type != MatchPolicy || p.action != ActionDirect {
+		t.Errorf("final rule: got %+v", p)
+	}
+	cases := []struct {
+		info    *ProxyInfo
+		isProxy int
+	}{
+		{&ProxyInfo{AddrType: Domain, Addr: "www.google.com:443"}, UseProxy},
+		{&ProxyInfo{AddrType: Domain, Addr: "www.example.org:80"}, UseProxy},
+		{&ProxyInfo{AddrType: Domain, Addr: "api.twitter.com:443"}, UseProxy},
+		{&ProxyInfo{AddrType: Domain, Addr: "a.cn.example.com:443"}, Direct},
+		{&ProxyInfo{AddrType: Ipv4, Addr: "1.2.3.4:443"}, UseProxy},
+	}
+	for _, c := range cases {
+		p := ps.findPolicy(c.info)
+		if p == nil || p.IsProxy != c.isProxy {
+			t.Errorf("%s: got %+v", c.info.Addr, p)
+		}
+	}
+}
+
+func TestLoadPolicySources(t *testing.T) {
+	dir := t.TempDir()
+	jsonFile := filepath.Join(dir, "policies.json")
+	clashFile := filepath.Join(dir, "clash.yaml")
+	_ = os.WriteFile(jsonFile, []byte(`[{"Type":"domain","Value":"google.com","IsProxy":0}]`), 0644)
+	_ = os.WriteFile(clashFile, []byte(clashConfig), 0644)
+
+	ps := &PolicySelector{}
+	skipped, err := ps.LoadSources([]PolicySource{
+		{Format: DraylixFormat, File: jsonFile},
+		{Format: ClashFormat, File: clashFile},
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(skipped) != 1 || skipped[0].File != clashFile {
+		t.Fatalf("unexpected skipped lines: %v", skipped)
+	}
+	p := ps.findPolicy(&ProxyInfo{AddrType: Domain, Addr: "google.com:443"})
+	if p == nil || p.IsProxy != Direct {
+		t.Errorf("earlier source should win, got %+v", p)
+	}
+
+	// 导入的 Clash IP 规则默认解析域名目标，no-resolve 的规则不解析
+	expires := time.Now().Add(time.Minute)
+	ps.dnsCache.put("v6.test", resolveEntry{ips: []net.IP{net.ParseIP("2001:db8::1")}, expires: expires})
+	ps.dnsCache.put("intranet.test", resolveEntry{ips: []net.IP{net.ParseIP("10.1.2.3")}, expires: expires})
+	if p := ps.findPolicy(&ProxyInfo{AddrType: Domain, Addr: "v6.test:443"}); p.Type != IPPolicy || p.IsProxy != Direct {
+		t.Errorf("resolved target: got %+v", p)
+	}
+	if p := ps.findPolicy(&ProxyInfo{AddrType: Domain, Addr: "intranet.test:443"}); p.Type != MatchPolicy {
+		t.Errorf("no-resolve rule matched a domain: got %+v", p)
+	}
+}
+
+func TestLoadPolicySourcesFinal(t *testing.T) {
+	dir := t.TempDir()
+	jsonFile := filepath.Join(dir, "policies.json")
+	gfwFile := filepath.Join(dir, "gfwlist.txt")
+	_ = os.WriteFile(jsonFile, []byte(`[{"Type":"domain","Value":"example.com","IsProxy":0},{"Type":"match","Action":"REJECT"}]`), 0644)
+	_ = os.WriteFile(gfwFile, []byte("||google.com\n"), 0644)
+	sources := []PolicySource{{Format: DraylixFormat, File: jsonFile}, {Format: GfwlistFormat, File: gfwFile, IsProxy: UseProxy}}
+
+	// 前面来源的 match 规则移到最后，后面来源的规则仍然有效，final 不再使用
+	ps := &PolicySelector{}
+	if _, err := ps.LoadSources(sources, ActionDirect); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		addr   string
+		action string
+	}{
+		{"example.com:443", ActionDirect},
+		{"www.google.com:443", ActionProxy},
+		{"other.org:443", ActionReject},
+	}
+	for _, c := range cases {
+		if action, _ := ps.findPolicy(&ProxyInfo{AddrType: Domain, Addr: c.addr}).Act(); action != c.action {
+			t.Errorf("%s: got %s, want %s", c.addr, action, c.action)
+		}
+	}
+
+	if _, err := ps.LoadSources(sources[1:], "BLOCK"); err == nil {
+		t.Error("expected error for invalid final action")
+	}
+}
@@ -0,0 +1,387 @@
+package network
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestSelector(t testing.TB, policies []*Policy) *PolicySelector {
+	ps := &PolicySelector{}
+	if err := ps.SetPolicies(policies); err != nil {
+		t.Fatal(err)
+	}
+	return ps
+}
+
+// linearPolicy 按顺序逐条匹配，作为编译后规则集的参照
+func linearPolicy(ps *PolicySelector, info *ProxyInfo) *Policy {
+	t, err := ps.newTarget(info)
+	if err != nil {
+		return nil
+	}
+	for _, p := range ps.Policies() {
+		if ok, _ := p.match(t); ok {
+			return p
+		}
+	}
+	return nil
+}
+
+func TestDomainPolicy(t *testing.T) {
+	policies := []*Policy{
+		{Type: DomainPolicy, Value: "example.com", IsProxy: Direct},
+		{Type: DomainPolicy, Value: ".google.com", IsProxy: UseProxy},
+		{Type: DomainKeywordPolicy, Value: "Tracker", IsProxy: Direct},
+		{Type: DomainRegexPolicy, Value: `^api\d+\.test\.io$`, IsProxy: UseProxy},
+		{Type: DomainSuffixPolicy, Value: "中国", IsProxy: Direct},
+		{Type: DomainSuffixPolicy, Value: "googlevideo.com", IsProxy: UseProxy},
+		{Type: MatchPolicy, Action: ActionReject},
+	}
+	ps := newTestSelector(t, policies)
+
+	cases := []struct {
+		addr string
+		want *Policy
+	}{
+		{"example.com:443", policies[0]},
+		{"EXAMPLE.com.:80", policies[0]},
+		{"www.example.com:443", policies[6]},
+		{"google.com:443", policies[1]},
+		{"mail.google.com:443", policies[1]},
+		{"notgoogle.com:443", policies[6]},
+		{"ads.tracker.net:80", policies[2]},
+		{"api12.test.io:443", policies[3]},
+		{"www.api12.test.io:443", policies[6]},
+		{"例子.中国:80", policies[4]},
+		{"xn--fsqu00a.xn--fiqs8s:80", policies[4]},
+		// 不符合 STD3 和连字符规则的真实主机名仍然匹配域名规则
+		{"r3---sn-ab5l6nzr.googlevideo.com:443", policies[5]},
+		{"My_Host.googlevideo.com:443", policies[5]},
+	}
+	for _, c := range cases {
+		got := ps.findPolicy(&ProxyInfo{AddrType: Domain, Addr: c.addr})
+		if got != c.want {
+			t.Errorf("%s: got %+v, want %+v", c.addr, got, c.want)
+		}
+	}
+}
+
+func TestIpPolicyOrder(t *testing.T) {
+	policies := []*Policy{
+		{Type: IPPolicy, Value: "10.1.0.0/16", IsProxy: Direct},
+		{Type: IPPolicy, Value: "10.0.0.0/8", IsProxy: UseProxy},
+		{Type: IPPolicy, Value: "10.1.2.0/24", IsProxy: UseProxy},
+		{Type: IPPolicy, Value: "0.0.0.0/0", IsProxy: UseProxy},
+		{Type: IPPolicy, Value: "fd00::/8", IsProxy: Direct},
+		{Type: MatchPolicy, IsProxy: Direct},
+	}
+	ps := newTestSelector(t, policies)
+
+	cases := []struct {
+		addr string
+		want *Policy
+	}{
+		{"10.1.2.3:80", policies[0]},
+		{"10.2.0.1:80", policies[1]},
+		{"192.168.1.1:80", policies[3]},
+		{"[fd00::1]:80", policies[4]},
+		{"[2001:db8::1]:80", policies[5]},
+	}
+	for _, c := range cases {
+		got := ps.findPolicy(&ProxyInfo{AddrType: Ipv4, Addr: c.addr})
+		if got != c.want {
+			t.Errorf("%s: got %+v, want %+v", c.addr, got, c.want)
+		}
+	}
+}
+
+func TestIpv4MappedPolicy(t *testing.T) {
+	policies := []*Policy{
+		{Type: IPPolicy, Value: "::ffff:10.0.0.0/104", IsProxy: Direct},
+		{Type: IPPolicy, Value: "::ffff:0:0/95", IsProxy: Direct},
+		{Type: MatchPolicy, IsProxy: UseProxy},
+	}
+	ps := newTestSelector(t, policies)
+	for _, c := range []struct {
+		addr string
+		want *Policy
+	}{
+		{"10.2.3.4:80", policies[0]},
+		{"11.0.0.1:80", policies[2]},
+		{"[::ffff:10.0.0.1]:80", policies[0]},
+	} {
+		info := &ProxyInfo{AddrType: Ipv4, Addr: c.addr}
+		if got := ps.findPolicy(info); got != c.want || got != linearPolicy(ps, info) {
+			t.Errorf("%s: got %+v, want %+v", c.addr, got, c.want)
+		}
+	}
+}
+
+func TestInvalidPolicy(t *testing.T) {
+	for _, p := range []*Policy{
+		{Type: DomainRegexPolicy, Value: "("},
+		{Type: IPPolicy, Value: "10.0.0.0"},
+		{Type: "unknown", Value: "x"},
+		{Type: MatchPolicy, Action: "PROXY:"},
+		{Type: MatchPolicy, Action: "BLOCK"},
+	} {
+		if err := p.compile(); err == nil {
+			t.Errorf("expected error for %+v", p)
+		}
+	}
+}
+
+func TestPolicyMustEndWithMatch(t *testing.T) {
+	ps := &PolicySelector{}
+	if err := ps.SetPolicies([]*Policy{{Type: DomainPolicy, Value: "a.com"}}); err == nil {
+		t.Error("expected error without match rule")
+	}
+	if err := ps.SetPolicies([]*Policy{{Type: MatchPolicy}, {Type: DomainPolicy, Value: "a.com"}}); err == nil {
+		t.Error("expected error for match rule before other rules")
+	}
+	p := ps.findPolicy(&ProxyInfo{AddrType: Domain, Addr: "a.com:80"})
+	if action, _ := p.Act(); action != ActionProxy {
+		t.Errorf("empty selector should proxy, got %s", action)
+	}
+}
+
+func TestPolicyActions(t *testing.T) {
+	policies := []*Policy{
+		{Type: DomainPolicy, Value: "ads.com", Action: "reject"},
+		{Type: DomainPolicy, Value: "drop.com", Action: ActionDrop},
+		{Type: DomainPolicy, Value: "jp.com", Action: "PROXY:Tokyo 1"},
+		{Type: DomainPolicy, Value: "cn.com", IsProxy: Direct},
+		{Type: MatchPolicy, IsProxy: UseProxy},
+	}
+	ps := newTestSelector(t, policies)
+	cases := []struct {
+		addr   string
+		action string
+		node   string
+	}{
+		{"ads.com:443", ActionReject, ""},
+		{"drop.com:443", ActionDrop, ""},
+		{"jp.com:443", ActionProxy, "Tokyo 1"},
+		{"cn.com:443", ActionDirect, ""},
+		{"other.com:443", ActionProxy, ""},
+	}
+	for _, c := range cases {
+		action, node := ps.findPolicy(&ProxyInfo{AddrType: Domain, Addr: c.addr}).Act()
+		if action != c.action || node != c.node {
+			t.Errorf("%s: got %s %q, want %s %q", c.addr, action, node, c.action, c.node)
+		}
+	}
+}
+
+func TestPolicyUnknownNode(t *testing.T) {
+	ps := &PolicySelector{}
+	ps.SetNodes([]string{"default", "tokyo"})
+	good := []*Policy{{Type: DomainPolicy, Value: "a.com", Action: "PROXY:tokyo"}, {Type: MatchPolicy, IsProxy: UseProxy}}
+	if err := ps.SetPolicies(good); err != nil {
+		t.Fatal(err)
+	}
+	bad := []*Policy{{Type: DomainPolicy, Value: "a.com", Action: "PROXY:tokio"}, {Type: MatchPolicy, IsProxy: UseProxy}}
+	var pe *PolicyError
+	if err := ps.SetPolicies(bad); !errors.As(err, &pe) || pe.Index != 0 {
+		t.Fatalf("got %v", err)
+	}
+	if ps.Policies()[0] != good[0] {
+		t.Error("unknown node replaced the old policies")
+	}
+}
+
+func TestEstablishInitialDataError(t *testing.T) {
+	ps := &PolicySelector{}
+	for _, c := range []struct {
+		proxyType   byte
+		established bool
+	}{{Socks5Proxy, true}, {HttpsProxy, true}, {HttpProxy, false}} {
+		local, app := net.Pipe()
+		go func() { _, _ = io.Copy(io.Discard, app) }()
+		remote, target := net.Pipe()
+		target.Close()
+		info := &ProxyInfo{ProxyType: c.proxyType, AddrType: Ipv4, Addr: "1.2.3.4:80", InitialData: []byte("hello")}
+		err := ps.establish(local, remote, info)
+		// 已经回复成功之后的错误不能再回复失败
+		if err == nil || errors.Is(err, ErrEstablished) != c.established {
+			t.Errorf("proxy type %d: got %v", c.proxyType, err)
+		}
+		local.Close()
+		remote.Close()
+	}
+}
+
+func TestSelectReject(t *testing.T) {
+	ps := newTestSelector(t, []*Policy{{Type: MatchPolicy, Action: ActionReject}})
+	local, app := net.Pipe()
+	defer app.Close()
+	go func() {
+		_, err := ps.Select(nil, local, &ProxyInfo{ProxyType: Socks5Proxy, AddrType: Domain, Addr: "a.com:80"})
+		if err != ErrPolicyReject {
+			t.Errorf("got %v", err)
+		}
+		_ = local.Close()
+	}()
+	reply, _ := io.ReadAll(app)
+	if !bytes.Equal(reply, socks5Rejected) {
+		t.Errorf("unexpected reply %v", reply)
+	}
+}
+
+func randomPolicies(r *rand.Rand, n int) []*Policy {
+	policies := make([]*Policy, 0, n)
+	for i := 0; i < n; i++ {
+		var p *Policy
+		switch r.Intn(10) {
+		case 0:
+			p = &Policy{Type: DomainPolicy, Value: fmt.Sprintf("host%d.site%d.com", r.Intn(50), r.Intn(2000))}
+		case 1:
+			p = &Policy{Type: DomainKeywordPolicy, Value: fmt.Sprintf("kw%d", r.Intn(100000))}
+		case 2, 3, 4, 5:
+			p = &Policy{Type: DomainSuffixPolicy, Value: fmt.Sprintf("site%d.com", r.Intn(20000))}
+		default:
+			ip := net.IPv4(byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), 0)
+			p = &Policy{Type: IPPolicy, Value: fmt.Sprintf("%s/%d", ip, 8+r.Intn(17))}
+		}
+		p.IsProxy = r.Intn(2)
+		policies = append(policies, p)
+	}
+	return append(policies, &Policy{Type: MatchPolicy, IsProxy: UseProxy})
+}
+
+func randomTarget(r *rand.Rand) *ProxyInfo {
+	if r.Intn(2) == 0 {
+		return &ProxyInfo{AddrType: Domain, Addr: fmt.Sprintf("host%d.site%d.com:443", r.Intn(50), r.Intn(2000))}
+	}
+	return &ProxyInfo{AddrType: Ipv4, Addr: fmt.Sprintf("%d.%d.%d.%d:443", r.Intn(256), r.Intn(256), r.Intn(256), r.Intn(256))}
+}
+
+func TestCompiledPolicyMatchesLinear(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	ps := newTestSelector(t, randomPolicies(r, 5000))
+	for i := 0; i < 5000; i++ {
+		info := randomTarget(r)
+		if got, want := ps.findPolicy(info), linearPolicy(ps, info); got != want {
+			t.Fatalf("%s: compiled %+v, linear %+v", info.Addr, got, want)
+		}
+	}
+}
+
+func BenchmarkPolicyLookup(b *testing.B) {
+	r := rand.New(rand.NewSource(1))
+	ps := newTestSelector(b, randomPolicies(r, 50000))
+	targets := make([]*ProxyInfo, 1024)
+	for i := range targets {
+		targets[i] = randomTarget(r)
+	}
+	b.Run("cached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			ps.findPolicy(targets[i%len(targets)])
+		}
+	})
+	b.Run("compiled", func(b *testing.B) {
+		ps.SetDecisionCacheSize(-1)
+		defer ps.SetDecisionCacheSize(0)
+		for i := 0; i < b.N; i++ {
+			ps.findPolicy(targets[i%len(targets)])
+		}
+	})
+	b.Run("linear", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			linearPolicy(ps, targets[i%len(targets)])
+		}
+	})
+}
+
+func TestExplain(t *testing.T) {
+	policies := []*Policy{
+		{Type: DomainSuffixPolicy, Value: "google.com", IsProxy: UseProxy},
+		{Type: IPPolicy, Value: "10.0.0.0/8", IsProxy: Direct},
+		{Type: IPPolicy, Value: "10.1.0.0/16", IsProxy: UseProxy},
+		{Type: MatchPolicy, Action: ActionReject},
+	}
+	ps := newTestSelector(t, policies)
+	e, err := ps.Explain(NewTargetInfo("10.1.2.3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(e.Rules) != 2 || e.Rules[0].Matched || !e.Rules[1].Matched {
+		t.Fatalf("unexpected trace %+v", e.Rules)
+	}
+	if e.Policy != policies[1] {
+		t.Fatalf("got %+v", e.Policy)
+	}
+	if e.GeoErr != errMMDBNotLoaded {
+		t.Errorf("got geo error %v", e.GeoErr)
+	}
+}
+
+func TestIpv6Target(t *testing.T) {
+	policies := []*Policy{
+		{Type: IPPolicy, Value: "2001:db8::/32", IsProxy: Direct},
+		{Type: MatchPolicy, IsProxy: UseProxy},
+	}
+	ps := newTestSelector(t, policies)
+	for _, target := range []string{"[2001:db8::1]:443", "2001:db8::1", "[2001:db8::1]"} {
+		info := NewTargetInfo(target)
+		if info.AddrType != Ipv6 {
+			t.Errorf("%s: got address type %d", target, info.AddrType)
+		}
+		if got := ps.findPolicy(info); got != policies[0] {
+			t.Errorf("%s: got %+v", target, got)
+		}
+	}
+	if reply := (&ProxyInfo{ProxyType: Socks5Proxy, AddrType: Ipv6}).getSuccessReply(); len(reply) != 22 || reply[3] != 0x04 {
+		t.Errorf("unexpected ipv6 reply %v", reply)
+	}
+}
+
+func TestResolvePolicy(t *testing.T) {
+	policies := []*Policy{
+		{Type: DomainSuffixPolicy, Value: "example.com", IsProxy: UseProxy},
+		{Type: IPPolicy, Value: "127.0.0.0/8", IsProxy: Direct, Resolve: true},
+		{Type: IPPolicy, Value: "::1/128", Action: ActionReject},
+		{Type: MatchPolicy, IsProxy: UseProxy},
+	}
+	ps := newTestSelector(t, policies)
+	ps.dnsCache.put("only6.test", resolveEntry{ips: []net.IP{net.ParseIP("::1")}, expires: time.Now().Add(time.Minute)})
+	ps.dnsCache.put("local.test", resolveEntry{ips: []net.IP{net.ParseIP("::1"), net.ParseIP("127.0.0.1")}, expires: time.Now().Add(time.Minute)})
+
+	check := func(addr string, want *Policy) {
+		t.Helper()
+		info := &ProxyInfo{AddrType: Domain, Addr: addr}
+		if got := ps.findPolicy(info); got != want {
+			t.Errorf("%s: got %+v, want %+v", addr, got, want)
+		}
+		if got := linearPolicy(ps, info); got != want {
+			t.Errorf("%s: linear got %+v, want %+v", addr, got, want)
+		}
+	}
+	check("local.test:80", policies[1])
+	check("only6.test:80", policies[3])
+
+	// 解析失败时的结果不缓存
+	ps.dnsCache.put("broken.test", resolveEntry{err: errors.New("timeout"), expires: time.Now().Add(time.Minute)})
+	cached := ps.decisions.len()
+	check("broken.test:80", policies[3])
+	if n := ps.decisions.len(); n != cached {
+		t.Errorf("decision after a failed lookup was cached")
+	}
+
+	ps.SetResolveAll(true)
+	check("local.test:80", policies[1])
+	check("only6.test:80", policies[2])
+
+	if _, err := ps.resolve("localhost"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ps.dnsCache.get("localhost"); !ok {
+		t.Error("resolve result was not cached")
+	}
+}
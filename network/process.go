@@ -0,0 +1,120 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	processCacheTTL  = 2 * time.Second
+	processCacheSize = 1024
+	recentProcesses  = 16
+)
+
+var errProcessUnsupported = errors.New("process lookup is not supported on this platform")
+var errNoSource = errors.New("source address is unknown")
+
+// ProcessInfo 是发起本地连接的进程，没有权限读取进程信息时只有 UID
+type ProcessInfo struct {
+	PID  int
+	Name string
+	Path string
+	UID  uint32
+}
+
+type processEntry struct {
+	info    *ProcessInfo
+	expires time.Time
+}
+
+// processCache 以 socket inode 为键缓存进程查询结果，并记住最近持有连接的进程。
+// 来源地址每个连接都不同，所以不用它做键；同一个应用的新连接通常来自同一个进程，
+// 先在最近的进程中找就不需要扫描所有进程的 fd
+type processCache struct {
+	mutex  sync.Mutex
+	inodes map[uint64]processEntry
+	recent []int
+}
+
+func (c *processCache) lookup(source string) (*ProcessInfo, error) {
+	if source == "" {
+		return nil, errNoSource
+	}
+	return findProcess(source, c)
+}
+
+func (c *processCache) get(inode uint64) (*ProcessInfo, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	e, ok := c.inodes[inode]
+	if !ok || time.Now().After(e.expires) {
+		return nil, false
+	}
+	return e.info, true
+}
+
+func (c *processCache) put(inode uint64, info *ProcessInfo) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.inodes == nil || len(c.inodes) >= processCacheSize {
+		c.inodes = make(map[uint64]processEntry)
+	}
+	c.inodes[inode] = processEntry{info: info, expires: time.Now().Add(processCacheTTL)}
+	if info.PID == 0 {
+		return
+	}
+	recent := []int{info.PID}
+	for _, pid := range c.recent {
+		if pid != info.PID && len(recent) < recentProcesses {
+			recent = append(recent, pid)
+		}
+	}
+	c.recent = recent
+}
+
+func (c *processCache) recentPids() []int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]int(nil), c.recent...)
+}
+
+// compileProcess 校验 process 和 uid 规则，uid 规则可以写用户名
+func (p *Policy) compileProcess() error {
+	p.Value = strings.TrimSpace(p.Value)
+	if p.Value == "" {
+		return fmt.Errorf("empty %s", p.Type)
+	}
+	if p.Type == ProcessPolicy {
+		return nil
+	}
+	uid, err := strconv.ParseUint(p.Value, 10, 32)
+	if err != nil {
+		u, lookupErr := user.Lookup(p.Value)
+		if lookupErr != nil {
+			return lookupErr
+		}
+		uid, err = strconv.ParseUint(u.Uid, 10, 32)
+		if err != nil {
+			return err
+		}
+	}
+	p.uid = uint32(uid)
+	return nil
+}
+
+// matchProcess 规则值包含路径分隔符时匹配可执行文件的完整路径，否则匹配文件名
+func matchProcess(p *Policy, proc *ProcessInfo) bool {
+	if proc.Path == "" && proc.Name == "" {
+		return false
+	}
+	if strings.ContainsRune(p.Value, filepath.Separator) {
+		return p.Value == proc.Path
+	}
+	return p.Value == proc.Name
+}
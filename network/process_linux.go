@@ -0,0 +1,150 @@
+package network
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const tcpListenState = "0A"
+
+// findProcess 通过 /proc/net/tcp{,6} 找到来源地址对应的 socket inode 和 UID，
+// 再在 /proc/<pid>/fd 中找到持有这个 socket 的进程，结果按 inode 缓存
+func findProcess(source string, cache *processCache) (*ProcessInfo, error) {
+	addr, err := net.ResolveTCPAddr("tcp", source)
+	if err != nil {
+		return nil, err
+	}
+	inode, uid, err := findSocket(addr)
+	if err != nil {
+		return nil, err
+	}
+	if info, ok := cache.get(inode); ok {
+		return info, nil
+	}
+	info := &ProcessInfo{UID: uid}
+	pid, err := socketOwner(inode, cache.recentPids())
+	if err != nil {
+		// 其他用户的进程没有权限读取，UID 仍然可以用于 uid 规则
+		return info, nil
+	}
+	info.PID = pid
+	if path, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid)); err == nil {
+		info.Path = strings.TrimSuffix(path, " (deleted)")
+		info.Name = filepath.Base(info.Path)
+	} else if comm, err := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid)); err == nil {
+		info.Name = strings.TrimSpace(string(comm))
+	}
+	cache.put(inode, info)
+	return info, nil
+}
+
+func findSocket(addr *net.TCPAddr) (inode uint64, uid uint32, err error) {
+	files := []string{"/proc/net/tcp6", "/proc/net/tcp"}
+	if addr.IP.To4() != nil {
+		files = []string{"/proc/net/tcp", "/proc/net/tcp6"}
+	}
+	for _, file := range files {
+		inode, uid, err = findSocketIn(file, addr)
+		if err == nil {
+			return inode, uid, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("no socket found for %s", addr)
+}
+
+func findSocketIn(file string, addr *net.TCPAddr) (uint64, uint32, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // 表头
+	for scanner.Scan() {
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 || fields[3] == tcpListenState {
+			continue
+		}
+		ip, port, err := parseProcAddr(fields[1])
+		if err != nil || port != addr.Port || !ip.Equal(addr.IP) {
+			continue
+		}
+		uid, err := strconv.ParseUint(fields[7], 10, 32)
+		if err != nil {
+			return 0, 0, err
+		}
+		inode, err := strconv.ParseUint(fields[9], 10, 64)
+		if err != nil || inode == 0 {
+			continue
+		}
+		return inode, uint32(uid), nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, 0, err
+	}
+	return 0, 0, fmt.Errorf("not found")
+}
+
+// parseProcAddr 解析 "0100007F:1F90" 形式的地址，IP 按 32 位字以主机字节序输出
+func parseProcAddr(s string) (net.IP, int, error) {
+	host, portHex, ok := strings.Cut(s, ":")
+	if !ok {
+		return nil, 0, fmt.Errorf("invalid address %q", s)
+	}
+	raw, err := hex.DecodeString(host)
+	if err != nil || (len(raw) != net.IPv4len && len(raw) != net.IPv6len) {
+		return nil, 0, fmt.Errorf("invalid address %q", s)
+	}
+	ip := make(net.IP, len(raw))
+	for i := 0; i < len(raw); i += 4 {
+		binary.NativeEndian.PutUint32(ip[i:], binary.BigEndian.Uint32(raw[i:]))
+	}
+	port, err := strconv.ParseUint(portHex, 16, 16)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ip, int(port), nil
+}
+
+// socketOwner 先在 recent 中的进程里找，找不到再扫描所有进程
+func socketOwner(inode uint64, recent []int) (int, error) {
+	target := fmt.Sprintf("socket:[%d]", inode)
+	for _, pid := range recent {
+		if ownsSocket(pid, target) {
+			return pid, nil
+		}
+	}
+	procs, err := os.ReadDir("/proc")
+	if err != nil {
+		return 0, err
+	}
+	for _, proc := range procs {
+		pid, err := strconv.Atoi(proc.Name())
+		if err == nil && ownsSocket(pid, target) {
+			return pid, nil
+		}
+	}
+	return 0, fmt.Errorf("no process owns socket %d", inode)
+}
+
+func ownsSocket(pid int, target string) bool {
+	fdDir := fmt.Sprintf("/proc/%d/fd", pid)
+	fds, err := os.ReadDir(fdDir)
+	if err != nil {
+		return false
+	}
+	for _, fd := range fds {
+		if link, err := os.Readlink(filepath.Join(fdDir, fd.Name())); err == nil && link == target {
+			return true
+		}
+	}
+	return false
+}
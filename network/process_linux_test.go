@@ -0,0 +1,120 @@
+package network
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// localPair 建立一条本机 TCP 连接，返回服务端看到的来源地址
+func localPair(t *testing.T, network, addr string) string {
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer listener.Close()
+	client, err := net.Dial(network, listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return server.RemoteAddr().String()
+}
+
+func TestFindProcess(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct{ network, addr string }{{"tcp4", "127.0.0.1:0"}, {"tcp6", "[::1]:0"}} {
+		source := localPair(t, c.network, c.addr)
+		cache := &processCache{}
+		proc, err := findProcess(source, cache)
+		if err != nil {
+			t.Fatalf("%s: %v", source, err)
+		}
+		if proc.PID != os.Getpid() || proc.Path != exe || proc.Name != filepath.Base(exe) || proc.UID != uint32(os.Getuid()) {
+			t.Errorf("%s: got %+v", source, proc)
+		}
+		// 第二次查询命中 inode 缓存，新连接先在最近的进程中找
+		if again, err := findProcess(source, cache); err != nil || again != proc {
+			t.Errorf("%s: not cached: %+v %v", source, again, err)
+		}
+		if pids := cache.recentPids(); len(pids) != 1 || pids[0] != os.Getpid() {
+			t.Errorf("recent pids: %v", pids)
+		}
+		next, err := findProcess(localPair(t, c.network, c.addr), cache)
+		if err != nil || next.PID != os.Getpid() || next == proc {
+			t.Errorf("new connection: %+v %v", next, err)
+		}
+	}
+}
+
+func TestProcessPolicy(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	policies := []*Policy{
+		{Type: ProcessPolicy, Value: "ssh", IsProxy: UseProxy},
+		{Type: ProcessPolicy, Value: filepath.Base(exe), Action: ActionReject},
+		{Type: UIDPolicy, Value: strconv.Itoa(os.Getuid()), IsProxy: Direct},
+		{Type: MatchPolicy, IsProxy: UseProxy},
+	}
+	ps := newTestSelector(t, policies)
+	source := localPair(t, "tcp4", "127.0.0.1:0")
+	info := &ProxyInfo{AddrType: Domain, Addr: "example.com:443", Source: source}
+	if got := ps.findPolicy(info); got != policies[1] {
+		t.Fatalf("got %+v", got)
+	}
+	if got := linearPolicy(ps, info); got != policies[1] {
+		t.Fatalf("linear got %+v", got)
+	}
+
+	// 不同进程的同一个目标不能共用缓存的结果
+	other := &ProxyInfo{AddrType: Domain, Addr: "example.com:443", Source: "127.0.0.1:1"}
+	if got := ps.findPolicy(other); got != policies[3] {
+		t.Fatalf("unknown process: got %+v", got)
+	}
+
+	// 更靠前的域名规则命中时不查进程，结果可以缓存
+	domainFirst := append([]*Policy{{Type: DomainPolicy, Value: "example.com", IsProxy: Direct}}, policies...)
+	ps = newTestSelector(t, domainFirst)
+	set := ps.policies.Load()
+	if i, cacheable := ps.lookupIndex(set, info); i != 0 || !cacheable {
+		t.Errorf("domain first: got %d cacheable=%v", i, cacheable)
+	}
+	miss := &ProxyInfo{AddrType: Domain, Addr: "example.org:443", Source: source}
+	if i, cacheable := ps.lookupIndex(set, miss); i != 2 || cacheable {
+		t.Errorf("process rule reached: got %d cacheable=%v", i, cacheable)
+	}
+	ps.findPolicy(info)
+	ps.findPolicy(miss)
+	if n := ps.decisions.len(); n != 1 {
+		t.Errorf("cached %d decisions, want 1", n)
+	}
+
+	policies[1].Value = "/usr/bin/" + filepath.Base(exe)
+	ps = newTestSelector(t, policies)
+	if got := ps.findPolicy(info); got != policies[2] {
+		t.Fatalf("uid: got %+v", got)
+	}
+}
+
+func TestParseProcAddr(t *testing.T) {
+	ip, port, err := parseProcAddr("0100007F:1F90")
+	if err != nil || !ip.Equal(net.IPv4(127, 0, 0, 1)) || port != 8080 {
+		t.Errorf("got %s %d %v", ip, port, err)
+	}
+	ip, _, err = parseProcAddr("00000000000000000000000001000000:0050")
+	if err != nil || !ip.Equal(net.IPv6loopback) {
+		t.Errorf("got %s %v", ip, err)
+	}
+}
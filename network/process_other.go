@@ -0,0 +1,7 @@
+//go:build !linux
+
+package network
+
+func findProcess(source string, cache *processCache) (*ProcessInfo, error) {
+	return nil, errProcessUnsupported
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/sha256"
 	"fmt"
 	"net"
+	"strings"
 )
 
 const (
@@ -12,23 +13,35 @@ const (
 	ChallengeRep
 	ChallengeReq
 	AuthSuccess
+	ConnectReq
+	// ConnectRep 是服务器连接目标的结果，客户端收到成功的结果后才回复本地应用
+	ConnectRep
 )
 
 const (
 	Ipv4 = iota
 	Domain
+	Ipv6
 )
 
 const (
 	HttpsProxy = byte(iota)
 	Socks5Proxy
 	HttpProxy
+	Socks4Proxy
 )
 
 var (
-	socks5Ipv4Start   = []byte{0x05, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
-	socks5DomainStart = []byte{0x05, 0x00, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
-	httpsStart        = []byte("HTTP/1.1 200 Connection established\r\n\r\n")
+	socks5Ipv4Start = []byte{0x05, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	socks5Ipv6Start = []byte{0x05, 0x00, 0x00, 0x04, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x00, 0x00}
+	httpsStart      = []byte("HTTP/1.1 200 Connection established\r\n\r\n")
+
+	// SOCKS4 的回复版本号为 0，0x5A 表示允许，0x5B 表示拒绝或失败
+	socks4Granted = []byte{0x00, 0x5A, 0, 0, 0, 0, 0, 0}
+
+	socks5Rejected = []byte{0x05, 0x02, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	socks4Rejected = []byte{0x00, 0x5B, 0, 0, 0, 0, 0, 0}
+	httpForbidden  = []byte("HTTP/1.1 403 Forbidden\r\nContent-Type: text/plain\r\nContent-Length: 37\r\nConnection: close\r\n\r\n403 Forbidden\nblocked by proxy rules\n")
 )
 
 var (
@@ -44,6 +57,8 @@ type ProxyInfo struct {
 	AddrType    byte
 	Addr        string
 	InitialData []byte
+	// Source 是本地应用的地址，用于 process 和 uid 规则
+	Source string
 }
 
 func (p *ProxyInfo) getSuccessReply() []byte {
@@ -53,11 +68,18 @@ func (p *ProxyInfo) getSuccessReply() []byte {
 	if p.ProxyType == HttpsProxy {
 		return httpsStart
 	}
+	if p.ProxyType == Socks4Proxy {
+		return socks4Granted
+	}
 	if p.ProxyType == Socks5Proxy {
-		if p.AddrType == Ipv4 {
+		switch p.AddrType {
+		case Ipv4:
+			return socks5Ipv4Start
+		case Ipv6:
+			return socks5Ipv6Start
+		default:
+			// 域名目标也用 IPv4 0.0.0.0:0 作为绑定地址
 			return socks5Ipv4Start
-		} else {
-			return socks5DomainStart
 		}
 	}
 
@@ -65,6 +87,17 @@ func (p *ProxyInfo) getSuccessReply() []byte {
 	return nil
 }
 
+// getRejectReply 返回规则拒绝连接时发给本地应用的回复
+func (p *ProxyInfo) getRejectReply() []byte {
+	switch p.ProxyType {
+	case Socks5Proxy:
+		return socks5Rejected
+	case Socks4Proxy:
+		return socks4Rejected
+	}
+	return httpForbidden
+}
+
 type AuthMessage struct {
 	UserId    string
 	Challenge Challenge
@@ -119,6 +152,18 @@ func BytesFormat(bytes int64) string {
 	}
 }
 
+// AddrTypeOf 根据主机名判断地址类型，IPv4 映射的 IPv6 地址按 IPv4 处理
+func AddrTypeOf(host string) byte {
+	ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"))
+	if ip == nil {
+		return Domain
+	}
+	if ip.To4() != nil {
+		return Ipv4
+	}
+	return Ipv6
+}
+
 func IsValidIP(host string) bool {
 	// 使用 net.ParseIP 函数判断是否是有效的 IP 地址
 	ip := net.ParseIP(host)
@@ -0,0 +1,248 @@
+package network
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const relayBufferSize = 32 * 1024
+
+// 连接结束的原因
+const (
+	CloseEOF      = "eof"
+	CloseIdle     = "idle timeout"
+	CloseLifetime = "max lifetime"
+	CloseError    = "error"
+)
+
+var relayBuffers = sync.Pool{
+	New: func() any {
+		buf := make([]byte, relayBufferSize)
+		return &buf
+	},
+}
+
+// RelayStats 是一次转发结束时的统计，Up 是本地到远端的字节数
+type RelayStats struct {
+	Up       int64
+	Down     int64
+	Duration time.Duration
+	Reason   string
+	// Err 是 Reason 为 CloseError 时的错误
+	Err error
+}
+
+// Relay 在本地连接和远端连接之间双向转发数据。
+// 零值可以直接使用，不限制空闲时间和连接时长
+type Relay struct {
+	// IdleTimeout 大于 0 时两个方向都没有数据超过这个时间就关闭连接
+	IdleTimeout time.Duration
+	// MaxLifetime 大于 0 时连接最长保持这个时间
+	MaxLifetime time.Duration
+	// OnTraffic 在每次转发数据后调用，例如用于统计速度
+	OnTraffic func(up bool, n int64)
+	// OnClose 在两个方向都结束后调用
+	OnClose func(stats RelayStats)
+}
+
+type relaySession struct {
+	relay      *Relay
+	local      net.Conn
+	remote     net.Conn
+	lastActive atomic.Int64
+	up         atomic.Int64
+	down       atomic.Int64
+	stopped    atomic.Bool
+	once       sync.Once
+	reason     string
+	err        error
+}
+
+// Run 转发数据直到两个方向都结束，一个方向读到 EOF 时对另一端 CloseWrite，
+// 不支持半关闭的连接直接关闭。返回前关闭两个连接
+func (r *Relay) Run(local, remote net.Conn) RelayStats {
+	start := time.Now()
+	s := &relaySession{relay: r, local: local, remote: remote}
+	s.lastActive.Store(start.UnixNano())
+
+	done := make(chan struct{})
+	if r.IdleTimeout > 0 || r.MaxLifetime > 0 {
+		go s.watch(start, done)
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.copy(remote, local, true)
+	}()
+	s.copy(local, remote, false)
+	wg.Wait()
+	close(done)
+	_ = local.Close()
+	_ = remote.Close()
+
+	return s.close(start)
+}
+
+// Meter 统计由调用者自己读写的本地连接，用于远端会变化的转发，例如逐个转发 HTTP 请求。
+// 读本地连接计为上行，写本地连接计为下行，空闲或时长超过限制时关闭本地连接。
+// stop 结束统计并调用 OnClose，之后的读写不再计数，不关闭连接
+func (r *Relay) Meter(local net.Conn) (conn net.Conn, stop func() RelayStats) {
+	start := time.Now()
+	s := &relaySession{relay: r, local: local}
+	s.lastActive.Store(start.UnixNano())
+
+	done := make(chan struct{})
+	if r.IdleTimeout > 0 || r.MaxLifetime > 0 {
+		go s.watch(start, done)
+	}
+	var once sync.Once
+	var stats RelayStats
+	return &meteredConn{Conn: local, s: s}, func() RelayStats {
+		once.Do(func() {
+			s.stopped.Store(true)
+			close(done)
+			stats = s.close(start)
+		})
+		return stats
+	}
+}
+
+type meteredConn struct {
+	net.Conn
+	s *relaySession
+}
+
+func (c *meteredConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.s.count(true, n)
+	return n, err
+}
+
+func (c *meteredConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.s.count(false, n)
+	return n, err
+}
+
+// close 记录结束原因并调用 OnClose
+func (s *relaySession) close(start time.Time) RelayStats {
+	s.finish(CloseEOF, nil)
+	stats := RelayStats{
+		Up:       s.up.Load(),
+		Down:     s.down.Load(),
+		Duration: time.Since(start),
+		Reason:   s.reason,
+		Err:      s.err,
+	}
+	if s.relay.OnClose != nil {
+		s.relay.OnClose(stats)
+	}
+	return stats
+}
+
+// finish 只记录第一个结束原因
+func (s *relaySession) finish(reason string, err error) {
+	s.once.Do(func() {
+		s.reason, s.err = reason, err
+	})
+}
+
+func (s *relaySession) abort(reason string, err error) {
+	s.finish(reason, err)
+	_ = s.local.Close()
+	if s.remote != nil {
+		_ = s.remote.Close()
+	}
+}
+
+func (s *relaySession) count(up bool, n int) {
+	if n <= 0 || s.stopped.Load() {
+		return
+	}
+	s.lastActive.Store(time.Now().UnixNano())
+	if up {
+		s.up.Add(int64(n))
+	} else {
+		s.down.Add(int64(n))
+	}
+	if s.relay.OnTraffic != nil {
+		s.relay.OnTraffic(up, int64(n))
+	}
+}
+
+func (s *relaySession) copy(dst, src net.Conn, up bool) {
+	bufp := relayBuffers.Get().(*[]byte)
+	defer relayBuffers.Put(bufp)
+	buf := *bufp
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			s.lastActive.Store(time.Now().UnixNano())
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				s.abort(CloseError, werr)
+				return
+			}
+			s.count(up, n)
+		}
+		if err == io.EOF {
+			if !closeWrite(dst) {
+				s.abort(CloseEOF, nil)
+			}
+			return
+		}
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				// 另一个方向或超时已经关闭了连接，原因已经记录
+				s.abort(CloseEOF, nil)
+			} else {
+				s.abort(CloseError, err)
+			}
+			return
+		}
+	}
+}
+
+// closeWrite 半关闭连接的写方向，连接不支持时返回 false
+func closeWrite(conn net.Conn) bool {
+	cw, ok := conn.(interface{ CloseWrite() error })
+	return ok && cw.CloseWrite() == nil
+}
+
+func (s *relaySession) watch(start time.Time, done <-chan struct{}) {
+	check := s.relay.IdleTimeout
+	if check <= 0 || (s.relay.MaxLifetime > 0 && s.relay.MaxLifetime < check) {
+		check = s.relay.MaxLifetime
+	}
+	timer := time.NewTimer(check)
+	defer timer.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-timer.C:
+			next := check
+			if s.relay.MaxLifetime > 0 {
+				left := s.relay.MaxLifetime - now.Sub(start)
+				if left <= 0 {
+					s.abort(CloseLifetime, nil)
+					return
+				}
+				next = min(next, left)
+			}
+			if s.relay.IdleTimeout > 0 {
+				left := s.relay.IdleTimeout - now.Sub(time.Unix(0, s.lastActive.Load()))
+				if left <= 0 {
+					s.abort(CloseIdle, nil)
+					return
+				}
+				next = min(next, left)
+			}
+			timer.Reset(next)
+		}
+	}
+}
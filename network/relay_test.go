@@ -0,0 +1,121 @@
+package network
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client.(*net.TCPConn), server.(*net.TCPConn)
+}
+
+func TestRelayHalfClose(t *testing.T) {
+	app, local := tcpPair(t)
+	remote, target := tcpPair(t)
+	go func() {
+		// 目标读到请求结束后才回复，类似 HTTP/1.0
+		req, _ := io.ReadAll(target)
+		_, _ = target.Write(append([]byte("re:"), req...))
+		target.Close()
+	}()
+
+	var traffic atomic.Int64
+	result := make(chan RelayStats, 1)
+	relay := &Relay{OnTraffic: func(up bool, n int64) { traffic.Add(n) }}
+	go func() { result <- relay.Run(local, remote) }()
+
+	_, _ = app.Write([]byte("request"))
+	_ = app.CloseWrite()
+	resp, err := io.ReadAll(app)
+	if err != nil || string(resp) != "re:request" {
+		t.Fatalf("got %q %v", resp, err)
+	}
+	stats := <-result
+	if stats.Up != 7 || stats.Down != 10 || stats.Reason != CloseEOF || traffic.Load() != 17 {
+		t.Errorf("got %+v, traffic %d", stats, traffic.Load())
+	}
+}
+
+func TestRelayTimeouts(t *testing.T) {
+	cases := []struct {
+		relay  Relay
+		active bool
+		reason string
+	}{
+		{Relay{IdleTimeout: 50 * time.Millisecond}, false, CloseIdle},
+		{Relay{IdleTimeout: 50 * time.Millisecond, MaxLifetime: 150 * time.Millisecond}, true, CloseLifetime},
+	}
+	for _, c := range cases {
+		app, local := tcpPair(t)
+		remote, _ := tcpPair(t)
+		stop := make(chan struct{})
+		if c.active {
+			go func() {
+				for {
+					select {
+					case <-stop:
+						return
+					case <-time.After(10 * time.Millisecond):
+						_, _ = app.Write([]byte("x"))
+					}
+				}
+			}()
+		}
+		var closed RelayStats
+		c.relay.OnClose = func(stats RelayStats) { closed = stats }
+		stats := c.relay.Run(local, remote)
+		close(stop)
+		if stats.Reason != c.reason || closed.Reason != c.reason {
+			t.Errorf("got %q, want %q", stats.Reason, c.reason)
+		}
+		if c.active && stats.Up == 0 {
+			t.Error("no bytes counted")
+		}
+	}
+}
+
+func TestRelayMeter(t *testing.T) {
+	app, local := tcpPair(t)
+	var traffic atomic.Int64
+	relay := &Relay{IdleTimeout: 50 * time.Millisecond, OnTraffic: func(up bool, n int64) { traffic.Add(n) }}
+	conn, stop := relay.Meter(local)
+
+	_, _ = app.Write([]byte("request"))
+	buf := make([]byte, 7)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = conn.Write([]byte("response"))
+	// 空闲超过限制时关闭本地连接
+	if _, err := io.ReadAll(app); err != nil {
+		t.Fatal(err)
+	}
+	stats := stop()
+	if stats.Up != 7 || stats.Down != 8 || stats.Reason != CloseIdle || traffic.Load() != 15 {
+		t.Errorf("got %+v, traffic %d", stats, traffic.Load())
+	}
+	_, _ = conn.Write([]byte("late"))
+	if again := stop(); again != stats || traffic.Load() != 15 {
+		t.Errorf("counted after stop: %+v, traffic %d", again, traffic.Load())
+	}
+}
@@ -0,0 +1,121 @@
+package network
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	resolveTimeout      = 5 * time.Second
+	resolveCacheTTL     = 5 * time.Minute
+	resolveFailCacheTTL = 30 * time.Second
+	resolveCacheSize    = 4096
+)
+
+type resolveEntry struct {
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+// resolveCache 缓存域名解析结果，失败的结果缓存较短时间
+type resolveCache struct {
+	mutex   sync.Mutex
+	entries map[string]resolveEntry
+}
+
+func (c *resolveCache) get(domain string) (resolveEntry, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	e, ok := c.entries[domain]
+	if !ok || time.Now().After(e.expires) {
+		return resolveEntry{}, false
+	}
+	return e, true
+}
+
+func (c *resolveCache) put(domain string, e resolveEntry) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]resolveEntry)
+	}
+	if len(c.entries) >= resolveCacheSize {
+		now := time.Now()
+		for k, v := range c.entries {
+			if now.After(v.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= resolveCacheSize {
+			c.entries = make(map[string]resolveEntry)
+		}
+	}
+	c.entries[domain] = e
+}
+
+func (c *resolveCache) clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries = nil
+}
+
+// SetResolver 设置解析域名目标使用的 DNS，nil 表示使用系统 DNS
+func (ps *PolicySelector) SetResolver(r *net.Resolver) {
+	ps.resolver.Store(r)
+	ps.dnsCache.clear()
+	ps.decisions.clear()
+}
+
+// SetResolveAll 为 true 时所有 IP 和地理位置规则都匹配域名目标解析出的地址，
+// 否则只有设置了 Resolve 的规则会解析
+func (ps *PolicySelector) SetResolveAll(all bool) {
+	ps.resolveAll.Store(all)
+	ps.decisions.clear()
+}
+
+func (ps *PolicySelector) resolve(domain string) ([]net.IP, error) {
+	if e, ok := ps.dnsCache.get(domain); ok {
+		return e.ips, e.err
+	}
+	r := ps.resolver.Load()
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	ips, err := r.LookupIP(ctx, "ip", domain)
+
+	e := resolveEntry{ips: ips, err: err, expires: time.Now().Add(resolveCacheTTL)}
+	if err != nil {
+		e.expires = time.Now().Add(resolveFailCacheTTL)
+	}
+	ps.dnsCache.put(domain, e)
+	return ips, err
+}
+
+// DialTunnel 通过服务器节点建立到 addr 的连接，返回的连接可以直接收发目标数据
+func DialTunnel(dialServer ServerDialer, node, addr string) (net.Conn, error) {
+	conn, err := dialServer(node)
+	if err != nil {
+		return nil, err
+	}
+	if err := requestConnect(conn, addr); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// NewTunnelResolver 返回一个通过隧道使用 TCP 查询 dnsServer 的解析器
+func NewTunnelResolver(dialServer ServerDialer, dnsServer string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			// 返回的不是 PacketConn，Go 的解析器会使用 TCP 格式的 DNS 消息
+			return DialTunnel(dialServer, "", dnsServer)
+		},
+	}
+}
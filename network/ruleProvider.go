@@ -0,0 +1,203 @@
+package network
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const maxRuleSetSize = 64 << 20
+
+// RuleProvider 是一个通过 URL 定期更新的规则来源，下载的内容缓存在 CacheFile，
+// 离线时使用缓存
+type RuleProvider struct {
+	Name    string
+	URL     string
+	Format  string
+	IsProxy int
+	// Interval 是刷新间隔，为 0 时只在启动时下载一次
+	Interval  time.Duration
+	CacheFile string
+	// SHA256 不为空时要求内容的 SHA-256 与之相同（十六进制）
+	SHA256 string `json:",omitempty"`
+	// PublicKey 不为空时要求内容带有 ed25519 签名（base64），签名从 SignatureURL 下载，默认为 URL + ".sig"
+	PublicKey    string `json:",omitempty"`
+	SignatureURL string `json:",omitempty"`
+	// ViaTunnel 为 true 时通过服务器下载，否则直连
+	ViaTunnel bool
+}
+
+// providerMeta 保存上次下载的缓存校验信息
+type providerMeta struct {
+	ETag         string
+	LastModified string
+}
+
+var ErrNotModified = errors.New("rule set not modified")
+
+// Source 返回读取缓存文件的规则来源
+func (rp *RuleProvider) Source() PolicySource {
+	return PolicySource{Format: rp.Format, File: rp.CacheFile, IsProxy: rp.IsProxy}
+}
+
+// Fetch 下载规则并在校验通过后写入缓存。内容没有变化时返回 ErrNotModified，
+// 任何错误都不会改动已有的缓存
+func (rp *RuleProvider) Fetch(client *http.Client) error {
+	req, err := http.NewRequest(http.MethodGet, rp.URL, nil)
+	if err != nil {
+		return err
+	}
+	meta := rp.readMeta()
+	if _, err := os.Stat(rp.CacheFile); err == nil {
+		if meta.ETag != "" {
+			req.Header.Set("If-None-Match", meta.ETag)
+		}
+		if meta.LastModified != "" {
+			req.Header.Set("If-Modified-Since", meta.LastModified)
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return ErrNotModified
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	data, err := readLimited(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if err := rp.verify(client, data); err != nil {
+		return err
+	}
+	if err := rp.validate(data); err != nil {
+		return err
+	}
+	if old, err := os.ReadFile(rp.CacheFile); err == nil && bytes.Equal(old, data) {
+		rp.writeMeta(resp.Header)
+		return ErrNotModified
+	}
+	if err := WriteFileAtomic(rp.CacheFile, data); err != nil {
+		return err
+	}
+	rp.writeMeta(resp.Header)
+	return nil
+}
+
+func (rp *RuleProvider) verify(client *http.Client, data []byte) error {
+	if rp.SHA256 != "" {
+		sum := sha256.Sum256(data)
+		if !strings.EqualFold(hex.EncodeToString(sum[:]), rp.SHA256) {
+			return fmt.Errorf("sha256 mismatch")
+		}
+	}
+	if rp.PublicKey == "" {
+		return nil
+	}
+	key, err := base64.StdEncoding.DecodeString(rp.PublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid public key")
+	}
+	sigURL := rp.SignatureURL
+	if sigURL == "" {
+		sigURL = rp.URL + ".sig"
+	}
+	resp, err := client.Get(sigURL)
+	if err != nil {
+		return fmt.Errorf("failed to download signature: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download signature: %s", resp.Status)
+	}
+	encoded, err := readLimited(resp.Body)
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil || !ed25519.Verify(key, data, sig) {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
+// validate 确认内容可以被解析，避免坏文件覆盖缓存
+func (rp *RuleProvider) validate(data []byte) error {
+	policies, _, err := rp.Source().Parse(data)
+	if err != nil {
+		return err
+	}
+	for i, p := range policies {
+		if err := p.compile(); err != nil {
+			return &PolicyError{Index: i, Policy: p, Err: err}
+		}
+	}
+	return nil
+}
+
+func (rp *RuleProvider) metaFile() string {
+	return rp.CacheFile + ".meta"
+}
+
+func (rp *RuleProvider) readMeta() providerMeta {
+	var meta providerMeta
+	data, err := os.ReadFile(rp.metaFile())
+	if err == nil {
+		_ = json.Unmarshal(data, &meta)
+	}
+	return meta
+}
+
+func (rp *RuleProvider) writeMeta(header http.Header) {
+	meta := providerMeta{ETag: header.Get("ETag"), LastModified: header.Get("Last-Modified")}
+	data, _ := json.Marshal(meta)
+	_ = WriteFileAtomic(rp.metaFile(), data)
+}
+
+func readLimited(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxRuleSetSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxRuleSetSize {
+		return nil, fmt.Errorf("rule set is larger than %d bytes", maxRuleSetSize)
+	}
+	return data, nil
+}
+
+// WriteFileAtomic 先写临时文件再改名，读取方不会看到写了一半的文件
+func WriteFileAtomic(file string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".tmp*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
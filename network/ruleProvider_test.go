@@ -0,0 +1,102 @@
+package network
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testRuleSet = `[{"Type":"domain","Value":".example.com","IsProxy":1},{"Type":"match","IsProxy":0}]`
+
+func newRuleServer(t *testing.T, body *string, sig *string) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/rules.sig" {
+			w.Write([]byte(*sig))
+			return
+		}
+		sum := sha256.Sum256([]byte(*body))
+		etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Write([]byte(*body))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestRuleProviderFetch(t *testing.T) {
+	body, sig := testRuleSet, ""
+	srv := newRuleServer(t, &body, &sig)
+	rp := &RuleProvider{Name: "test", URL: srv.URL + "/rules", Format: DraylixFormat,
+		CacheFile: filepath.Join(t.TempDir(), "rules.json")}
+
+	if err := rp.Fetch(srv.Client()); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(rp.CacheFile); err != nil || string(data) != testRuleSet {
+		t.Fatalf("cache: %q %v", data, err)
+	}
+	if err := rp.Fetch(srv.Client()); err != ErrNotModified {
+		t.Fatalf("expected ErrNotModified, got %v", err)
+	}
+
+	// 内容无效或服务器不可用时保留缓存
+	body = `[{"Type":"ip","Value":"not a cidr","IsProxy":1}]`
+	if err := rp.Fetch(srv.Client()); err == nil {
+		t.Fatal("expected error for invalid rule set")
+	}
+	srv.Close()
+	if err := rp.Fetch(srv.Client()); err == nil {
+		t.Fatal("expected error when server is down")
+	}
+	if data, _ := os.ReadFile(rp.CacheFile); string(data) != testRuleSet {
+		t.Fatalf("cache was overwritten: %q", data)
+	}
+	policies, _, err := rp.Source().Load()
+	if err != nil || len(policies) != 2 {
+		t.Fatalf("load cache: %v %v", policies, err)
+	}
+}
+
+func TestRuleProviderVerify(t *testing.T) {
+	body := testRuleSet
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(priv, []byte(body)))
+	srv := newRuleServer(t, &body, &sig)
+	sum := sha256.Sum256([]byte(body))
+
+	rp := &RuleProvider{Name: "test", URL: srv.URL + "/rules", Format: DraylixFormat,
+		CacheFile: filepath.Join(t.TempDir(), "rules.json"),
+		SHA256:    hex.EncodeToString(sum[:]), PublicKey: base64.StdEncoding.EncodeToString(pub)}
+	if err := rp.Fetch(srv.Client()); err != nil {
+		t.Fatal(err)
+	}
+
+	bad := *rp
+	bad.CacheFile = filepath.Join(t.TempDir(), "bad.json")
+	bad.SHA256 = hex.EncodeToString(make([]byte, 32))
+	if err := bad.Fetch(srv.Client()); err == nil {
+		t.Error("expected sha256 mismatch")
+	}
+
+	bad.SHA256 = ""
+	sig = base64.StdEncoding.EncodeToString(ed25519.Sign(priv, []byte("other")))
+	if err := bad.Fetch(srv.Client()); err == nil {
+		t.Error("expected invalid signature")
+	}
+	if _, err := os.Stat(bad.CacheFile); err == nil {
+		t.Error("cache written despite failed verification")
+	}
+}
@@ -0,0 +1,125 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/file"
+	"net"
+	"time"
+)
+
+const maxScriptSize = 4096
+
+// scriptNow 是脚本看到的当前时间，测试中可以替换
+var scriptNow = time.Now
+
+// scriptEnv 是 script 规则可以使用的变量和函数。需要查询的值（解析结果、GeoIP、进程）
+// 写成函数，只有脚本用到时才查询。例如：
+//
+//	port == 443 && domain endsWith ".io" && hour < 22
+//	country() in ["CN", "HK"] || process() == "steam"
+type scriptEnv struct {
+	Host    string `expr:"host"`   // 域名或 IP
+	Domain  string `expr:"domain"` // 目标是 IP 时为空
+	IP      string `expr:"ip"`     // 目标是域名时为空
+	Port    int    `expr:"port"`
+	Source  string `expr:"source"` // 本地应用的地址
+	Hour    int    `expr:"hour"`
+	Minute  int    `expr:"minute"`
+	Weekday int    `expr:"weekday"` // 0 为星期日
+
+	IPs     func() []string            `expr:"ips"`     // 目标 IP 或域名解析出的所有地址
+	Country func() string              `expr:"country"` // 目标 IP 或第一个解析地址的国家代码
+	Process func() string              `expr:"process"` // 发起连接的进程名，未知时为空
+	UID     func() int                 `expr:"uid"`     // 发起连接的用户，未知时为 -1
+	InCidr  func(ip, cidr string) bool `expr:"inCidr"`
+}
+
+// compileScript 在加载时编译脚本，错误信息带有行号和列号
+func (p *Policy) compileScript() error {
+	if len(p.Value) > maxScriptSize {
+		return fmt.Errorf("script is longer than %d bytes", maxScriptSize)
+	}
+	program, err := expr.Compile(p.Value, expr.Env(scriptEnv{}), expr.AsBool())
+	if err != nil {
+		var fileErr *file.Error
+		if errors.As(err, &fileErr) {
+			return fmt.Errorf("line %d, column %d: %s", fileErr.Line, fileErr.Column+1, fileErr.Message)
+		}
+		return err
+	}
+	p.script = program
+	return nil
+}
+
+func (p *Policy) runScript(t *matchTarget) (bool, error) {
+	result, err := expr.Run(p.script, t.scriptEnv())
+	if err != nil {
+		return false, err
+	}
+	return result.(bool), nil
+}
+
+func (t *matchTarget) scriptEnv() scriptEnv {
+	now := scriptNow()
+	env := scriptEnv{
+		Domain:  t.domain,
+		Port:    t.port,
+		Source:  t.source,
+		Hour:    now.Hour(),
+		Minute:  now.Minute(),
+		Weekday: int(now.Weekday()),
+		IPs:     t.scriptIPs,
+		Country: t.scriptCountry,
+		Process: func() string {
+			if proc, err := t.process(); err == nil {
+				return proc.Name
+			}
+			return ""
+		},
+		UID: func() int {
+			if proc, err := t.process(); err == nil {
+				return int(proc.UID)
+			}
+			return -1
+		},
+		InCidr: func(ip, cidr string) bool {
+			ok, _ := matchIp(cidr, net.ParseIP(ip))
+			return ok
+		},
+	}
+	env.Host = t.domain
+	if t.ip != nil {
+		env.IP = t.ip.String()
+		env.Host = env.IP
+	}
+	return env
+}
+
+func (t *matchTarget) scriptIPs() []string {
+	if t.ip != nil {
+		return []string{t.ip.String()}
+	}
+	targets, _ := t.resolvedTargets()
+	ips := make([]string, len(targets))
+	for i, rt := range targets {
+		ips[i] = rt.ip.String()
+	}
+	return ips
+}
+
+func (t *matchTarget) scriptCountry() string {
+	target := t
+	if t.ip == nil {
+		targets, _ := t.resolvedTargets()
+		if len(targets) == 0 {
+			return ""
+		}
+		target = targets[0]
+	}
+	if record, err := target.geo(); err == nil {
+		return record.CountryCode
+	}
+	return ""
+}
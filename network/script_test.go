@@ -0,0 +1,115 @@
+package network
+
+import (
+	"Draylix2/dlog"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScriptPolicy(t *testing.T) {
+	policies := []*Policy{
+		{Type: ScriptPolicy, Value: `port == 443 && domain endsWith ".io" && hour < 22`, IsProxy: UseProxy},
+		{Type: ScriptPolicy, Value: `inCidr(ip, "10.0.0.0/8") || country() == "CN"`, Action: ActionReject},
+		{Type: ScriptPolicy, Value: "weekday == 0 &&\n  host contains \"game\"", IsProxy: Direct},
+		{Type: ScriptPolicy, Value: `ips()[3] == "1.1.1.1"`, IsProxy: Direct},
+		{Type: MatchPolicy, Action: ActionDrop},
+	}
+	ps := newGeoTestSelector(t, policies)
+	defer func() { scriptNow = time.Now }()
+
+	sunday := time.Date(2024, 3, 3, 23, 30, 0, 0, time.Local)
+	cases := []struct {
+		now  time.Time
+		info *ProxyInfo
+		want *Policy
+	}{
+		{sunday.Add(-2 * time.Hour), &ProxyInfo{AddrType: Domain, Addr: "api.example.io:443"}, policies[0]},
+		{sunday, &ProxyInfo{AddrType: Domain, Addr: "api.example.io:443"}, policies[4]},
+		{sunday, &ProxyInfo{AddrType: Domain, Addr: "api.example.io:80"}, policies[4]},
+		{sunday, &ProxyInfo{AddrType: Ipv4, Addr: "10.1.2.3:80"}, policies[1]},
+		{sunday, &ProxyInfo{AddrType: Ipv4, Addr: "5.0.0.1:80"}, policies[1]},
+		{sunday, &ProxyInfo{AddrType: Domain, Addr: "game.example.com:80"}, policies[2]},
+		{sunday.Add(24 * time.Hour), &ProxyInfo{AddrType: Domain, Addr: "game.example.com:80"}, policies[4]},
+	}
+	for _, c := range cases {
+		scriptNow = func() time.Time { return c.now }
+		if got := ps.findPolicy(c.info); got != c.want {
+			t.Errorf("%s at %s: got %+v, want %+v", c.info.Addr, c.now, got, c.want)
+		}
+		if got := linearPolicy(ps, c.info); got != c.want {
+			t.Errorf("%s at %s: linear got %+v, want %+v", c.info.Addr, c.now, got, c.want)
+		}
+	}
+}
+
+func TestScriptCache(t *testing.T) {
+	policies := []*Policy{
+		{Type: DomainSuffixPolicy, Value: "example.com", IsProxy: Direct},
+		{Type: ScriptPolicy, Value: `hour < 12`, Action: ActionReject},
+		{Type: MatchPolicy, IsProxy: UseProxy},
+	}
+	ps := newTestSelector(t, policies)
+	defer func() { scriptNow = time.Now }()
+	morning := time.Date(2024, 3, 3, 9, 0, 0, 0, time.Local)
+	scriptNow = func() time.Time { return morning }
+
+	// 域名规则在脚本之前命中，结果照常缓存
+	direct := &ProxyInfo{AddrType: Domain, Addr: "www.example.com:443"}
+	if got := ps.findPolicy(direct); got != policies[0] {
+		t.Fatalf("got %+v", got)
+	}
+	// 执行过脚本的结果不缓存，时间变化后重新计算
+	other := &ProxyInfo{AddrType: Domain, Addr: "www.example.org:443"}
+	if got := ps.findPolicy(other); got != policies[1] {
+		t.Fatalf("morning: got %+v", got)
+	}
+	scriptNow = func() time.Time { return morning.Add(6 * time.Hour) }
+	if got := ps.findPolicy(other); got != policies[2] {
+		t.Fatalf("afternoon: got %+v", got)
+	}
+	if n := ps.decisions.len(); n != 1 {
+		t.Errorf("cached %d decisions, want 1", n)
+	}
+}
+
+func TestScriptRuntimeError(t *testing.T) {
+	policies := []*Policy{
+		{Type: ScriptPolicy, Value: `ips()[3] == "1.1.1.1"`, IsProxy: Direct},
+		{Type: MatchPolicy, Action: ActionReject},
+	}
+	ps := newTestSelector(t, policies)
+	var logs bytes.Buffer
+	writers := dlog.LogWriters
+	dlog.LogWriters = []io.Writer{&logs}
+	defer func() { dlog.LogWriters = writers }()
+
+	if got := ps.findPolicy(&ProxyInfo{AddrType: Ipv4, Addr: "10.0.0.1:80"}); got != policies[1] {
+		t.Fatalf("got %+v", got)
+	}
+	if !strings.Contains(logs.String(), "script rule #0: ") || !strings.Contains(logs.String(), "out of range") {
+		t.Errorf("runtime error not logged: %q", logs.String())
+	}
+}
+
+func TestScriptCompileError(t *testing.T) {
+	cases := []struct {
+		script string
+		want   string
+	}{
+		{"port == 443 &&\n  domain endsWith", "line 2"},
+		{`port == "443"`, "line 1"},
+		{`host`, "expected bool"},
+		{`os.Exit(1) == nil`, "line 1"},
+		{strings.Repeat("1 == 1 && ", maxScriptSize) + "true", "longer than"},
+	}
+	for _, c := range cases {
+		p := &Policy{Type: ScriptPolicy, Value: c.script}
+		err := p.compile()
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%q: got %v, want error containing %q", c.script, err, c.want)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"Draylix2/network"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+type sourceFlags []network.PolicySource
+
+func (s *sourceFlags) String() string {
+	return fmt.Sprint(*s)
+}
+
+func (s *sourceFlags) Set(value string) error {
+	format, file, ok := strings.Cut(value, ":")
+	if !ok {
+		return fmt.Errorf("expected format:file, got %s", value)
+	}
+	*s = append(*s, network.PolicySource{Format: format, File: file})
+	return nil
+}
+
+type stringFlags []string
+
+func (s *stringFlags) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringFlags) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// policyTest 实现 draylix policy test <host[:port]>，打印每条规则的匹配过程
+func policyTest(args []string) int {
+	fs := flag.NewFlagSet("policy test", flag.ContinueOnError)
+	policies := fs.String("policies", "policies.json", "draylix policies json file")
+	mmdb := fs.String("mmdb", "", "GeoIP2 City or Country mmdb file")
+	asn := fs.String("asn", "", "GeoLite2 ASN mmdb file")
+	countryOnly := fs.Bool("country-only", false, "use Country lookups only")
+	final := fs.String("final", "", "action used when no source has a match rule (default PROXY)")
+	resolveAll := fs.Bool("resolve-all", false, "match ip and location rules against resolved addresses of domains")
+	var sources sourceFlags
+	fs.Var(&sources, "source", "extra policy source as format:file (draylix, clash, gfwlist), repeatable")
+	var hostEntries, hostsFiles stringFlags
+	fs.Var(&hostEntries, "host", "pin a domain (or *.domain) to an ip as name=ip, repeatable")
+	fs.Var(&hostsFiles, "hosts", "hosts file in /etc/hosts format, repeatable")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: draylix policy test [flags] <host[:port]>")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	ps := &network.PolicySelector{}
+	ps.SetCountryOnly(*countryOnly)
+	ps.SetResolveAll(*resolveAll)
+	if *asn != "" {
+		db, err := network.OpenASNDB(*asn)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		ps.SetASNDB(db)
+	}
+	if *mmdb != "" {
+		db, err := network.OpenMMDB(*mmdb)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		ps.SetMMDB(db)
+	}
+	hosts := network.NewHosts()
+	for _, entry := range hostEntries {
+		name, ip, ok := strings.Cut(entry, "=")
+		if !ok {
+			fmt.Fprintf(os.Stderr, "expected name=ip, got %s\n", entry)
+			return 2
+		}
+		if err := hosts.Add(name, ip); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	for _, file := range hostsFiles {
+		skipped, err := hosts.LoadHostsFile(file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		for _, e := range skipped {
+			fmt.Fprintf(os.Stderr, "skip hosts entry %s\n", e)
+		}
+	}
+	ps.SetHosts(hosts)
+	if *policies != "" {
+		sources = append([]network.PolicySource{{Format: network.DraylixFormat, File: *policies}}, sources...)
+	}
+	skipped, err := ps.LoadSources(sources, *final)
+	for _, e := range skipped {
+		fmt.Fprintf(os.Stderr, "skip unsupported rule %s\n", e)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	e, err := ps.Explain(network.NewTargetInfo(fs.Arg(0)))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Print(e)
+	return 0
+}
@@ -31,6 +31,11 @@ type ClientTUI struct {
 
 	ProxyControl func(on bool)
 	proxyHint    *tview.TextView
+
+	// ModeControl 切换路由模式，返回错误时界面不变
+	ModeControl func(mode string) error
+	mode        string
+	modeHint    *tview.TextView
 }
 
 func (ct *ClientTUI) SetAddress(addr string) {
@@ -272,8 +277,12 @@ func (ct *ClientTUI) initBott() *tview.Flex {
 func (ct *ClientTUI) initMenu() *tview.Flex {
 	_, proxyHint, proxyFlex := initFlexKV("[Ctrl+D]:", "System Proxy On")
 	ct.proxyHint = proxyHint
+	_, modeHint, modeFlex := initFlexKV("[Ctrl+R]:", "Mode: "+network.ModeRule)
+	ct.mode = network.ModeRule
+	ct.modeHint = modeHint
 	menu := tview.NewFlex().SetDirection(tview.FlexRow)
 	menu.AddItem(proxyFlex, 0, 1, true)
+	menu.AddItem(modeFlex, 0, 1, false)
 
 	ct.initMenuEvent(menu)
 	return menu
@@ -284,6 +293,8 @@ func (ct *ClientTUI) initMenuEvent(menu *tview.Flex) {
 		switch event.Key() {
 		case tcell.KeyCtrlD:
 			ct.SetProxy(!ct.proxyOn)
+		case tcell.KeyCtrlR:
+			ct.nextMode()
 		}
 		return event
 	})
@@ -302,3 +313,27 @@ func (ct *ClientTUI) SetProxy(status bool) {
 	})
 	ct.proxyOn = status
 }
+
+// nextMode 按 rule -> global -> direct 的顺序切换路由模式
+func (ct *ClientTUI) nextMode() {
+	next := map[string]string{
+		network.ModeRule:   network.ModeGlobal,
+		network.ModeGlobal: network.ModeDirect,
+		network.ModeDirect: network.ModeRule,
+	}[ct.mode]
+	if ct.ModeControl != nil {
+		if err := ct.ModeControl(next); err != nil {
+			ct.Log(err.Error())
+			return
+		}
+	}
+	ct.SetMode(next)
+}
+
+// SetMode 只更新界面上显示的路由模式
+func (ct *ClientTUI) SetMode(mode string) {
+	ct.submitDraw(func() {
+		ct.mode = mode
+		ct.modeHint.SetText("Mode: " + mode)
+	})
+}